@@ -5,7 +5,6 @@ import (
 	"os"
 	"strings"
 
-	"github.com/invopop/yaml"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
@@ -15,21 +14,29 @@ type appContext struct {
 	cliContext *cli.Context
 
 	// Values from CLI context
-	locators       map[string]string
-	appsFilePath   string
-	usageFilePath  string
-	outputFilePath string
+	locators           map[string]string
+	appsFilePath       string
+	usageFilePath      string
+	overlayFilePaths   []string
+	outputFilePath     string
+	boundaryReportPath string
 
 	// Values from loaded YAML files
 	apps Apps
 	ru   *ResourceUsage
 
 	// Derived Values
-	ksaNames      map[AppName]KSAName
-	gsaNames      map[AppName]GSAName
-	rsrcFullNames RsrcFullNameMap
+	appDecls        map[AppName]AppDecl // with namespace defaults applied
+	runtimes        map[string]RuntimeBindings
+	ksaNames        map[AppName]KSAName
+	gsaNames        map[AppName]GSAName
+	members         map[AppName]Principal // for apps and declared principals
+	rsrcFullNames   RsrcFullNameMap
+	rsrcDecls       map[RsrcKind]map[RsrcName]RsrcDecl // selected for this run
+	unselectedRsrcs map[RsrcKind]map[RsrcName]bool     // not selected for this run
 
-	rpm ResourcePolicyMap
+	rpm                 ResourcePolicyMap
+	crossBoundaryGrants []crossBoundaryGrant
 }
 
 func NewAppContext(c *cli.Context) (*appContext, error) {
@@ -42,6 +49,7 @@ func NewAppContext(c *cli.Context) (*appContext, error) {
 		"company":  "yoyodyne",
 		"provider": provider,
 		"region":   region,
+		"location": regionLocations[provider][region],
 		"stage":    c.String(StageFlag.Name),
 	}
 	lvs := c.StringSlice(LocatorFlag.Name)
@@ -51,33 +59,121 @@ func NewAppContext(c *cli.Context) (*appContext, error) {
 	}
 	log.WithField("locators", locators).Debug("locator info")
 	ac := &appContext{
-		cliContext:     c,
-		appsFilePath:   c.Path(AppsFileFlag.Name),
-		usageFilePath:  c.Path(UsageFileFlag.Name),
-		outputFilePath: c.Path(OutputFileFlag.Name),
-		locators:       locators,
-		ksaNames:       make(map[AppName]KSAName),
-		gsaNames:       make(map[AppName]GSAName),
-		rsrcFullNames:  newRsrcFullNameMap(),
-		rpm:            make(ResourcePolicyMap),
+		cliContext:         c,
+		appsFilePath:       c.Path(AppsFileFlag.Name),
+		usageFilePath:      c.Path(UsageFileFlag.Name),
+		overlayFilePaths:   c.StringSlice(OverlayFileFlag.Name),
+		outputFilePath:     c.Path(OutputFileFlag.Name),
+		boundaryReportPath: c.Path(BoundaryReportFileFlag.Name),
+		locators:           locators,
 	}
+	ac.initDerivedValues()
 	return ac, nil
 }
 
+func (ac *appContext) initDerivedValues() {
+	ac.appDecls = make(map[AppName]AppDecl)
+	ac.runtimes = make(map[string]RuntimeBindings)
+	ac.ksaNames = make(map[AppName]KSAName)
+	ac.gsaNames = make(map[AppName]GSAName)
+	ac.members = make(map[AppName]Principal)
+	ac.rsrcFullNames = newRsrcFullNameMap()
+	ac.rsrcDecls = make(map[RsrcKind]map[RsrcName]RsrcDecl)
+	ac.unselectedRsrcs = make(map[RsrcKind]map[RsrcName]bool)
+	ac.rpm = make(ResourcePolicyMap)
+}
+
+// withLocators returns a copy of ac, sharing its loaded input files, whose locators
+// are overridden by the given values. The copy has no derived values yet.
+func (ac *appContext) withLocators(overrides map[string]string) (*appContext, error) {
+	locators := make(map[string]string, len(ac.locators))
+	for k, v := range ac.locators {
+		locators[k] = v
+	}
+	for k, v := range overrides {
+		locators[k] = v
+	}
+	provider, region := locators["provider"], locators["region"]
+	if !supportedRegions[provider][region] {
+		return nil, fmt.Errorf(`region %v not supported for provider %v`, region, provider)
+	}
+	locators["location"] = regionLocations[provider][region]
+
+	n := &appContext{
+		cliContext:         ac.cliContext,
+		appsFilePath:       ac.appsFilePath,
+		usageFilePath:      ac.usageFilePath,
+		overlayFilePaths:   ac.overlayFilePaths,
+		outputFilePath:     ac.outputFilePath,
+		boundaryReportPath: ac.boundaryReportPath,
+		locators:           locators,
+		apps:               ac.apps,
+		ru:                 ac.ru,
+	}
+	n.initDerivedValues()
+	return n, nil
+}
+
+// loadAppsFile loads the apps file, or merges the apps files in a directory or
+// matching a glob.
 func (ac *appContext) loadAppsFile() error {
-	y, err := os.ReadFile(ac.appsFilePath)
-	if err == nil {
-		err = yaml.Unmarshal(y, &ac.apps)
+	paths, err := expandInputPath(ac.appsFilePath)
+	if err != nil {
+		return errors.WithMessage(err, "loadAppsFile")
 	}
-	return errors.WithMessage(err, "loadAppsFile")
+	m := newInputMerger()
+	ac.apps = make(Apps)
+	for _, path := range paths {
+		var apps Apps
+		y, err := os.ReadFile(path)
+		if err == nil {
+			err = unmarshalYAML(y, &apps)
+		}
+		if err == nil {
+			err = m.mergeApps(ac.apps, apps, path)
+		}
+		if err != nil {
+			return errors.WithMessage(err, "loadAppsFile")
+		}
+	}
+	return nil
 }
 
+// loadResourceUsageFile loads the resource usage file, or merges the resource usage
+// files in a directory or matching a glob.
 func (ac *appContext) loadResourceUsageFile() error {
-	y, err := os.ReadFile(ac.usageFilePath)
+	paths, err := expandInputPath(ac.usageFilePath)
+	if err != nil {
+		return errors.WithMessage(err, "loadResourceUsageFile")
+	}
+	m := newInputMerger()
+	ac.ru = &ResourceUsage{}
+	for _, path := range paths {
+		var ru *ResourceUsage
+		y, err := os.ReadFile(path)
+		if err == nil {
+			err = unmarshalYAML(y, &ru)
+		}
+		if err == nil {
+			err = m.mergeResourceUsage(ac.ru, ru, path)
+		}
+		if err != nil {
+			return errors.WithMessage(err, "loadResourceUsageFile")
+		}
+	}
+	return nil
+}
+
+func (ac *appContext) loadOverlayFile(path string) error {
+	var overlay UsageOverlay
+	y, err := os.ReadFile(path)
+	if err == nil {
+		err = unmarshalYAML(y, &overlay)
+	}
 	if err == nil {
-		err = yaml.Unmarshal(y, &ac.ru)
+		err = ac.ru.applyOverlay(&overlay, path)
 	}
-	return errors.WithMessage(err, "loadResourceUsageFile")
+	return errors.WithMessage(err, "loadOverlayFile")
 }
 
 func (ac *appContext) load() error {
@@ -91,5 +187,18 @@ func (ac *appContext) load() error {
 	}
 	log.WithField("ac.ru", ac.ru).Debug("loaded resource usage file")
 
+	for _, overlayFilePath := range ac.overlayFilePaths {
+		paths, err := expandInputPath(overlayFilePath)
+		if err != nil {
+			return errors.WithMessage(err, "loadOverlayFile")
+		}
+		for _, path := range paths {
+			if err := ac.loadOverlayFile(path); err != nil {
+				return err
+			}
+			log.WithField("path", path).Debug("applied usage overlay file")
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// andConditions returns a condition that holds when all of conditions hold; nil
+// conditions always hold.
+func andConditions(conditions ...*IAMCondition) *IAMCondition {
+	var titles, descriptions, expressions []string
+	for _, c := range conditions {
+		if c == nil {
+			continue
+		}
+		titles = append(titles, c.Title)
+		if len(c.Description) > 0 {
+			descriptions = append(descriptions, c.Description)
+		}
+		expressions = append(expressions, c.Expression)
+	}
+	switch len(expressions) {
+	case 0:
+		return nil
+	case 1:
+		return &IAMCondition{
+			Title:       titles[0],
+			Description: strings.Join(descriptions, "; "),
+			Expression:  expressions[0],
+		}
+	}
+	return &IAMCondition{
+		Title:       strings.Join(titles, ", "),
+		Description: strings.Join(descriptions, "; "),
+		Expression:  "(" + strings.Join(expressions, ") && (") + ")",
+	}
+}
+
+// expiryCondition limits a binding to requests made before t. If t is a midnight,
+// the binding is titled by the last day it is in effect.
+func expiryCondition(t time.Time) *IAMCondition {
+	title := "expires " + t.Format(time.RFC3339)
+	if t.Equal(t.Truncate(24 * time.Hour)) {
+		title = "through " + t.AddDate(0, 0, -1).Format("2006-01-02")
+	}
+	return &IAMCondition{
+		Title:      title,
+		Expression: fmt.Sprintf(`request.time < timestamp("%s")`, t.Format(time.RFC3339)),
+	}
+}
+
+// usageCondition returns the condition under which a usage entry is allowed, or nil
+// if it is allowed unconditionally.
+func usageCondition(e UsageEntry) *IAMCondition {
+	var expiry *IAMCondition
+	if !e.expiresAt.IsZero() {
+		expiry = expiryCondition(e.expiresAt)
+	}
+	return andConditions(e.Condition, expiry)
+}
+
+// spannerDatabaseRoleCondition limits a binding to one fine-grained database role
+// of a Spanner database.
+func spannerDatabaseRoleCondition(dbFullName RsrcFullName, dbRole string) *IAMCondition {
+	return &IAMCondition{
+		Title: "database role " + dbRole,
+		Expression: fmt.Sprintf(`resource.type == "spanner.googleapis.com/DatabaseRole" && resource.name == "%s/databaseRoles/%s"`,
+			dbFullName, dbRole),
+	}
+}
+
+// firestoreDatabaseCondition limits a (project-level) binding to one Firestore
+// database, since Firestore databases do not have IAM policies of their own.
+func firestoreDatabaseCondition(dbFullName RsrcFullName) *IAMCondition {
+	return &IAMCondition{
+		Title:      "database " + path.Base(string(dbFullName)),
+		Expression: fmt.Sprintf(`resource.name == "%s"`, dbFullName),
+	}
+}
+
+// objectPrefixCondition limits a bucket binding to objects whose names start with
+// prefix. Note that bucket-level permissions (e.g., listing objects) are not granted
+// by a binding with this condition, since the bucket's own name does not match.
+func objectPrefixCondition(bucketFullName RsrcFullName, prefix string) *IAMCondition {
+	return &IAMCondition{
+		Title:      "objects " + prefix + "*",
+		Expression: fmt.Sprintf(`resource.name.startsWith("%s/objects/%s")`, bucketFullName, prefix),
+	}
+}
@@ -14,6 +14,46 @@ var (
 	supportedRegions = map[string]map[string]bool{
 		"gcp": {
 			"usce1": true,
+			"euwe1": true,
 		},
 	}
+
+	// Maps short region codes to the provider's location names
+	regionLocations = map[string]map[string]string{
+		"gcp": {
+			"usce1": "us-central1",
+			"euwe1": "europe-west1",
+		},
+	}
+
+	// Locators a resource declaration may override, for resources of other
+	// companies, units or stages (see RsrcDecl.Locators).
+	rsrcLocatorOverrides = map[string]bool{
+		"company": true,
+		"unit":    true,
+		"stage":   true,
+	}
+
+	defaultRuntime = "gke"
+
+	// Identity bindings per runtime, unless overridden in the resource usage file.
+	// GKE apps authenticate through workload identity, impersonating their GSAs
+	// via their KSAs; apps on other runtimes run directly as their GSAs.
+	defaultRuntimes = map[string]RuntimeBindings{
+		"gke": {
+			Self:             []IAMRole{"roles/iam.serviceAccountTokenCreator"},
+			WorkloadIdentity: []IAMRole{"roles/iam.workloadIdentityUser"},
+		},
+		"cloudrun": {},
+		"gce":      {},
+		"none":     {},
+	}
+
+	// Project-level roles every app needs on its runtime project, unless overridden.
+	defaultBaselineRoles = []IAMRole{
+		"roles/logging.logWriter",
+		"roles/monitoring.metricWriter",
+		"roles/cloudtrace.agent",
+		"roles/errorreporting.writer",
+	}
 )
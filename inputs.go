@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/invopop/yaml"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// expandInputPath returns the files named by an input path: the YAML files in it if
+// it is a directory, the files matching it if it is a glob, or else just the path.
+func expandInputPath(path string) ([]string, error) {
+	if strings.ContainsAny(path, `*?[`) {
+		paths, err := filepath.Glob(path)
+		if err == nil && len(paths) == 0 {
+			err = fmt.Errorf(`no files match %v`, path)
+		}
+		sort.Strings(paths)
+		return paths, err
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return []string{path}, nil // let the caller report any error reading it
+	}
+	var paths []string
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(path, pattern))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf(`no YAML files in %v`, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// unmarshalYAML unmarshals an input file. Unlike yaml.Unmarshal, it leaves timestamps
+// as written, rather than converting them to RFC 3339 timestamps; otherwise a date
+// (e.g., "expires: 2026-12-31") could not be told from a timestamp of its midnight.
+func unmarshalYAML(y []byte, o interface{}) error {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(y, &doc); err != nil {
+		return err
+	}
+	if doc.Kind != 0 {
+		quoteTimestamps(&doc)
+		var err error
+		if y, err = yamlv3.Marshal(&doc); err != nil {
+			return err
+		}
+	}
+	return yaml.Unmarshal(y, o)
+}
+
+// quoteTimestamps makes each timestamp in the YAML node tree a string.
+func quoteTimestamps(n *yamlv3.Node) {
+	if n.Kind == yamlv3.ScalarNode && n.ShortTag() == "!!timestamp" {
+		n.Tag, n.Style = "!!str", yamlv3.DoubleQuotedStyle
+	}
+	for _, c := range n.Content {
+		quoteTimestamps(c)
+	}
+}
+
+// inputMerger merges input files, remembering which file defined what, so that a
+// duplicate definition can be reported along with both of its sources.
+type inputMerger struct {
+	sources map[string]string // definition -> path of file defining it
+}
+
+func newInputMerger() *inputMerger {
+	return &inputMerger{sources: make(map[string]string)}
+}
+
+// define records that path defines what is described by format and args. It is an
+// error if another file already defined it; duplicates within a file are left to
+// the checks made once all files are merged (e.g., of an app in two namespaces).
+func (m *inputMerger) define(path, format string, args ...interface{}) error {
+	what := fmt.Sprintf(format, args...)
+	if other, ok := m.sources[what]; ok && other != path {
+		return fmt.Errorf(`%v defined in both %v and %v`, what, other, path)
+	}
+	m.sources[what] = path
+	return nil
+}
+
+// mergeApps merges the apps loaded from path into dst.
+func (m *inputMerger) mergeApps(dst Apps, src Apps, path string) error {
+	for nsName, ns := range src {
+		if err := m.define(path, "namespace %v", nsName); err != nil {
+			return err
+		}
+		for _, appDecl := range ns.Apps {
+			if err := m.define(path, "app %v", appDecl.Name); err != nil {
+				return err
+			}
+		}
+		dst[nsName] = ns
+	}
+	return nil
+}
+
+// mergeResourceUsage merges the resource usage loaded from path into dst. Each
+// resource (for the runs its declaration selects), principal, app's usage, etc. may
+// be defined in only one file.
+func (m *inputMerger) mergeResourceUsage(dst *ResourceUsage, src *ResourceUsage, path string) error {
+	if src == nil {
+		return nil
+	}
+
+	if dst.Resources == nil {
+		dst.Resources = make(Resources)
+	}
+	for rsrcKind, ownedBy := range src.Resources {
+		if dst.Resources[rsrcKind] == nil {
+			dst.Resources[rsrcKind] = make(map[RsrcOwnerKey][]RsrcDecl)
+		}
+		for ownerKey, rsrcDecls := range ownedBy {
+			for _, rsrcDecl := range rsrcDecls {
+				if err := m.define(path, "%v", describeRsrcDecl(rsrcKind, rsrcDecl)); err != nil {
+					return err
+				}
+			}
+			dst.Resources[rsrcKind][ownerKey] = append(dst.Resources[rsrcKind][ownerKey], rsrcDecls...)
+		}
+	}
+
+	if dst.Owners == nil {
+		dst.Owners = make(Owners)
+	}
+	for ownerKey, ownerDecl := range src.Owners {
+		if err := m.define(path, "owner %v", ownerKey); err != nil {
+			return err
+		}
+		dst.Owners[ownerKey] = ownerDecl
+	}
+
+	// Permissions are merged by resource kind.
+	dstPerms, srcPerms := reflect.ValueOf(&dst.Permissions).Elem(), reflect.ValueOf(src.Permissions)
+	for i := 0; i < srcPerms.NumField(); i++ {
+		if srcPerms.Field(i).IsZero() {
+			continue
+		}
+		tag := srcPerms.Type().Field(i).Tag.Get("json")
+		if err := m.define(path, "%v permissions", tag); err != nil {
+			return err
+		}
+		dstPerms.Field(i).Set(srcPerms.Field(i))
+	}
+
+	for _, p := range []struct {
+		kind     string
+		dst, src *map[AppName]string
+	}{
+		{"group", &dst.Principals.Groups, &src.Principals.Groups},
+		{"user", &dst.Principals.Users, &src.Principals.Users},
+		{"service account", &dst.Principals.ServiceAccounts, &src.Principals.ServiceAccounts},
+		{"principal set", &dst.Principals.PrincipalSets, &src.Principals.PrincipalSets},
+	} {
+		if *p.dst == nil {
+			*p.dst = make(map[AppName]string)
+		}
+		for name, value := range *p.src {
+			if err := m.define(path, "principal %v", name); err != nil {
+				return err
+			}
+			(*p.dst)[name] = value
+		}
+	}
+
+	if dst.Runtimes == nil {
+		dst.Runtimes = make(map[string]RuntimeBindings)
+	}
+	for name, rb := range src.Runtimes {
+		if err := m.define(path, "runtime %v", name); err != nil {
+			return err
+		}
+		dst.Runtimes[name] = rb
+	}
+
+	if src.BaselineRoles != nil {
+		if err := m.define(path, "baseline roles"); err != nil {
+			return err
+		}
+		dst.BaselineRoles = src.BaselineRoles
+	}
+
+	if dst.Usage == nil {
+		dst.Usage = make(Usage)
+	}
+	for appName, appUsage := range src.Usage {
+		if err := m.define(path, "usage for %v", appName); err != nil {
+			return err
+		}
+		dst.Usage[appName] = appUsage
+	}
+
+	if dst.NamespaceUsage == nil {
+		dst.NamespaceUsage = make(NamespaceUsage)
+	}
+	for nsName, nsUsage := range src.NamespaceUsage {
+		if err := m.define(path, "usage for namespace %v", nsName); err != nil {
+			return err
+		}
+		dst.NamespaceUsage[nsName] = nsUsage
+	}
+
+	if dst.NodeUsage == nil {
+		dst.NodeUsage = make(AppUsage)
+	}
+	for rsrcKind, rsrcKindUsage := range src.NodeUsage {
+		if err := m.define(path, "%v node usage", rsrcKind); err != nil {
+			return err
+		}
+		dst.NodeUsage[rsrcKind] = rsrcKindUsage
+	}
+
+	if dst.ProjectNumbers == nil {
+		dst.ProjectNumbers = make(ProjectNumbers)
+	}
+	for project, number := range src.ProjectNumbers {
+		if err := m.define(path, "project number of %v", project); err != nil {
+			return err
+		}
+		dst.ProjectNumbers[project] = number
+	}
+	return nil
+}
+
+// describeRsrcDecl describes a resource declaration, including the runs it selects,
+// since a resource may have other declarations for other runs.
+func describeRsrcDecl(rsrcKind RsrcKind, rsrcDecl RsrcDecl) string {
+	desc := fmt.Sprintf("%v resource %v", rsrcKind, rsrcDecl.Name)
+	if runs := rsrcDecl.describe(); len(runs) > 0 {
+		desc += " for " + runs
+	}
+	return desc
+}
@@ -0,0 +1,148 @@
+package main
+
+import "testing"
+
+func TestInputMergerDefine(t *testing.T) {
+	m := newInputMerger()
+	if err := m.define("a.yaml", "app %v", "candy"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := m.define("a.yaml", "namespace %v", "candy"); err != nil {
+		t.Fatalf("unexpected error defining another kind of thing of the same name: %v", err)
+	}
+	if err := m.define("a.yaml", "app %v", "candy"); err != nil {
+		t.Fatalf("unexpected error defining a thing twice in one file: %v", err)
+	}
+	err := m.define("b.yaml", "app %v", "candy")
+	if want := "app candy defined in both a.yaml and b.yaml"; err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+func TestMergeResourceUsageDuplicates(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		a, b ResourceUsage
+		err  string // empty if the files merge
+	}{
+		{
+			name: "distinct",
+			a:    ResourceUsage{Usage: Usage{"app1": {}}},
+			b:    ResourceUsage{Usage: Usage{"app2": {}}},
+		},
+		{
+			name: "resource",
+			a:    ResourceUsage{Resources: Resources{rkBuckets: {"core": {{Name: "b1"}}}}},
+			b:    ResourceUsage{Resources: Resources{rkBuckets: {"billing": {{Name: "b1"}}}}},
+			err:  "buckets resource b1 defined in both a.yaml and b.yaml",
+		},
+		{
+			name: "resource for the same runs",
+			a:    ResourceUsage{Resources: Resources{rkBuckets: {"core": {{Name: "b1", Selector: Selector{Stages: []string{"prod"}}}}}}},
+			b:    ResourceUsage{Resources: Resources{rkBuckets: {"core": {{Name: "b1", Selector: Selector{Stages: []string{"prod"}}}}}}},
+			err:  "buckets resource b1 for stages prod defined in both a.yaml and b.yaml",
+		},
+		{
+			name: "resource for other runs",
+			a:    ResourceUsage{Resources: Resources{rkBuckets: {"core": {{Name: "b1", Selector: Selector{Stages: []string{"prod"}}}}}}},
+			b:    ResourceUsage{Resources: Resources{rkBuckets: {"core": {{Name: "b1", Selector: Selector{Stages: []string{"dev", "stg"}}}}}}},
+		},
+		{
+			name: "same name, different kinds",
+			a:    ResourceUsage{Resources: Resources{rkBuckets: {"core": {{Name: "x"}}}}},
+			b:    ResourceUsage{Resources: Resources{rkTopics: {"core": {{Name: "x"}}}}},
+		},
+		{
+			name: "owner",
+			a:    ResourceUsage{Owners: Owners{"core": {Project: "p1"}}},
+			b:    ResourceUsage{Owners: Owners{"core": {Project: "p2"}}},
+			err:  "owner core defined in both a.yaml and b.yaml",
+		},
+		{
+			name: "permissions",
+			a:    ResourceUsage{Permissions: Permissions{Buckets: BucketPermissions{Read: []IAMRole{"r1"}}}},
+			b:    ResourceUsage{Permissions: Permissions{Buckets: BucketPermissions{Write: []IAMRole{"r2"}}}},
+			err:  "buckets permissions defined in both a.yaml and b.yaml",
+		},
+		{
+			name: "principal of another type",
+			a:    ResourceUsage{Principals: Principals{Groups: map[AppName]string{"eng": "eng@example.com"}}},
+			b:    ResourceUsage{Principals: Principals{Users: map[AppName]string{"eng": "eng@example.com"}}},
+			err:  "principal eng defined in both a.yaml and b.yaml",
+		},
+		{
+			name: "usage",
+			a:    ResourceUsage{Usage: Usage{"app1": {}}},
+			b:    ResourceUsage{Usage: Usage{"app1": {}}},
+			err:  "usage for app1 defined in both a.yaml and b.yaml",
+		},
+		{
+			name: "baseline roles",
+			a:    ResourceUsage{BaselineRoles: []IAMRole{"r1"}},
+			b:    ResourceUsage{BaselineRoles: []IAMRole{"r1"}},
+			err:  "baseline roles defined in both a.yaml and b.yaml",
+		},
+		{
+			name: "project number",
+			a:    ResourceUsage{ProjectNumbers: ProjectNumbers{"p": "1"}},
+			b:    ResourceUsage{ProjectNumbers: ProjectNumbers{"p": "1"}},
+			err:  "project number of p defined in both a.yaml and b.yaml",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newInputMerger()
+			var ru ResourceUsage
+			if err := m.mergeResourceUsage(&ru, &tc.a, "a.yaml"); err != nil {
+				t.Fatalf("unexpected error merging a.yaml: %v", err)
+			}
+			err := m.mergeResourceUsage(&ru, &tc.b, "b.yaml")
+			switch {
+			case len(tc.err) == 0 && err != nil:
+				t.Errorf("unexpected error merging b.yaml: %v", err)
+			case len(tc.err) > 0 && (err == nil || err.Error() != tc.err):
+				t.Errorf("got error %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestMergeAppsDuplicates(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		a, b Apps
+		err  string // empty if the files merge
+	}{
+		{
+			name: "distinct",
+			a:    Apps{"ns1": {Apps: []AppDecl{{Name: "app1"}}}},
+			b:    Apps{"ns2": {Apps: []AppDecl{{Name: "app2"}}}},
+		},
+		{
+			name: "namespace",
+			a:    Apps{"ns1": {Apps: []AppDecl{{Name: "app1"}}}},
+			b:    Apps{"ns1": {Apps: []AppDecl{{Name: "app2"}}}},
+			err:  "namespace ns1 defined in both a.yaml and b.yaml",
+		},
+		{
+			name: "app in another namespace",
+			a:    Apps{"ns1": {Apps: []AppDecl{{Name: "app1"}}}},
+			b:    Apps{"ns2": {Apps: []AppDecl{{Name: "app1"}}}},
+			err:  "app app1 defined in both a.yaml and b.yaml",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newInputMerger()
+			apps := make(Apps)
+			if err := m.mergeApps(apps, tc.a, "a.yaml"); err != nil {
+				t.Fatalf("unexpected error merging a.yaml: %v", err)
+			}
+			err := m.mergeApps(apps, tc.b, "b.yaml")
+			switch {
+			case len(tc.err) == 0 && err != nil:
+				t.Errorf("unexpected error merging b.yaml: %v", err)
+			case len(tc.err) > 0 && (err == nil || err.Error() != tc.err):
+				t.Errorf("got error %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
@@ -64,19 +64,38 @@ var (
 	AppsFileFlag = cli.PathFlag{
 		Name:    "apps-file",
 		Aliases: []string{"a"},
-		Usage:   "Path to apps YAML file",
+		Usage:   "Path to apps YAML file, or to a directory of (or glob matching) apps YAML files to merge",
 		Value:   "./apps.yaml",
 	}
 	UsageFileFlag = cli.PathFlag{
 		Name:    "usage-file",
 		Aliases: []string{"u"},
-		Usage:   "Path to resource usage YAML file",
+		Usage:   "Path to resource usage YAML file, or to a directory of (or glob matching) resource usage YAML files to merge",
 		Value:   "./resource-usage.yaml",
 	}
+	OverlayFileFlag = cli.StringSliceFlag{
+		Name:    "overlay-file",
+		Aliases: []string{"O"},
+		Usage:   "Path to a usage overlay YAML file (or directory or glob), applied to the resource usage file; may be repeated, and overlays are applied in order",
+	}
 	OutputFileFlag = cli.PathFlag{
 		Name:    "output-file",
 		Aliases: []string{"o"},
-		Usage:   "Path to newline-delimited JSON output file (default: stdout)",
+		Usage:   "Path to newline-delimited JSON output file (default: stdout); a template such as \"{{ .L.stage }}-{{ .L.region }}.json\" with --matrix",
+	}
+	BoundaryReportFileFlag = cli.PathFlag{
+		Name:    "boundary-report-file",
+		Aliases: []string{"R"},
+		Usage:   "Path to newline-delimited JSON report of grants across company, unit or stage boundaries (default: logged as warnings); a template with --matrix, as for --output-file",
+	}
+	MatrixFlag = cli.StringFlag{
+		Name:    "matrix",
+		Aliases: []string{"m"},
+		Usage:   "Generate output for each combination of \"`stages x regions [x units]`\", e.g. \"dev,stg,prod x usce1,euwe1\"",
+		Action: func(ctx *cli.Context, v string) error {
+			_, err := parseMatrix(v, ctx.String(ProviderFlag.Name))
+			return err
+		},
 	}
 
 	flags = []cli.Flag{
@@ -88,8 +107,11 @@ var (
 		&AppsFileFlag,
 		// TODO: probably load permissions from separate file
 		&UsageFileFlag,
+		&OverlayFileFlag,
 		// Add a dry-run/validate-only mode?
 		&OutputFileFlag,
+		&BoundaryReportFileFlag,
+		&MatrixFlag,
 	}
 )
 
@@ -108,16 +130,29 @@ func genResourceAuth(c *cli.Context) error {
 	// TODO: Validate inputs
 	// ... FIXME ...
 
+	if matrix := c.String(MatrixFlag.Name); len(matrix) > 0 {
+		return genMatrix(ac, matrix) // matrix.go
+	}
+	_, err = ac.generate()
+	return err
+}
+
+// generate derives policies from ac's loaded input files and writes them to ac's
+// output file. It returns the output by resource.
+func (ac *appContext) generate() (map[RsrcFullName][]byte, error) {
 	// Derive SA names and full resource names
 	// TODO: check/enforce length/syntax constraints
 	if err := ac.deriveNames(); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Construct resource policies based on intended usage
 	// TODO: Check/enforce that app/resource references match declarations
 	if err := ac.derivePolicies(); err != nil {
-		return err
+		return nil, err
+	}
+	if err := ac.reportCrossBoundaryGrants(); err != nil {
+		return nil, err
 	}
 
 	// For each resource, output its computed policy.
@@ -133,17 +168,19 @@ func genResourceAuth(c *cli.Context) error {
 	if len(ac.outputFilePath) == 0 {
 		f = os.Stdout
 	} else {
+		var err error
 		f, err = os.OpenFile(ac.outputFilePath, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
 			log.WithError(err).Errorf("%s: error opening file", ac.outputFilePath)
-			return err
+			return nil, err
 		}
 	}
 	writer := bufio.NewWriter(f)
 
+	output := make(map[RsrcFullName][]byte, len(keys))
 	for _, r := range keys {
 		p := ac.rpm[RsrcFullName(r)]
-		if len(p.roleBindingsMap) == 0 {
+		if len(p.roleBindingsMap) == 0 && len(p.Notifications) == 0 {
 			// This is a bit of a hack. It avoids printing a policy
 			// that names a resource but has no bindings; for example,
 			// if only one of "publish" or "subscribe" was specified
@@ -156,6 +193,7 @@ func genResourceAuth(c *cli.Context) error {
 		if err != nil {
 			log.WithError(err).Errorf("%s: marshal", r)
 		} else {
+			output[RsrcFullName(r)] = b
 			_, err := writer.WriteString(string(b) + "\n")
 			if err != nil {
 				log.WithError(err).Errorf("write error")
@@ -166,7 +204,7 @@ func genResourceAuth(c *cli.Context) error {
 	if f != os.Stdout {
 		f.Close()
 	}
-	return nil
+	return output, nil
 }
 
 func main() {
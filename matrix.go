@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// matrixDims are the locators that a matrix varies, in the order given.
+var matrixDims = []string{"stage", "region", "unit"}
+
+// parseMatrix parses a matrix specification of the form "stages x regions [x units]",
+// each a comma-separated list, into the locator overrides of each combination.
+func parseMatrix(spec string, provider string) ([]map[string]string, error) {
+	dims := regexp.MustCompile(`\s+x\s+`).Split(strings.TrimSpace(spec), -1)
+	if len(dims) < 2 || len(dims) > len(matrixDims) {
+		return nil, fmt.Errorf(`matrix "%v" malformed; expected "stages x regions [x units]"`, spec)
+	}
+
+	combos := []map[string]string{{}}
+	for i, dim := range dims {
+		locator := matrixDims[i]
+		var next []map[string]string
+		for _, v := range strings.Split(dim, ",") {
+			v = strings.TrimSpace(v)
+			switch {
+			case len(v) == 0:
+				return nil, fmt.Errorf(`matrix "%v" has an empty %s`, spec, locator)
+			case locator == "stage" && !supportedLevels[v]:
+				return nil, fmt.Errorf(`stage %v not supported`, v)
+			case locator == "region" && !supportedRegions[provider][v]:
+				return nil, fmt.Errorf(`region %v not supported for provider %v`, v, provider)
+			}
+			for _, combo := range combos {
+				c := map[string]string{locator: v}
+				for k, cv := range combo {
+					c[k] = cv
+				}
+				next = append(next, c)
+			}
+		}
+		combos = next
+	}
+	return combos, nil
+}
+
+func matrixLabel(locators map[string]string) string {
+	var parts []string
+	for _, dim := range matrixDims {
+		if v, ok := locators[dim]; ok {
+			parts = append(parts, v)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// genMatrix generates output for each combination of a matrix concurrently, with
+// each combination's output file (and boundary report file, if any) named by
+// executing the output file path (which must therefore be a template) with the
+// combination's locators. Once all are generated, combinations that disagree on a
+// resource's policy are reported.
+func genMatrix(base *appContext, spec string) error {
+	combos, err := parseMatrix(spec, base.locators["provider"])
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(base.outputFilePath, "{{") {
+		return fmt.Errorf(`--matrix requires an --output-file template such as "{{ .L.stage }}-{{ .L.region }}.json"`)
+	}
+	outputFileT, err := template.New("outputFile").Option("missingkey=error").Parse(base.outputFilePath)
+	if err != nil {
+		return errors.WithMessage(err, "output file template")
+	}
+	var boundaryReportT *template.Template
+	if len(base.boundaryReportPath) > 0 {
+		if !strings.Contains(base.boundaryReportPath, "{{") {
+			return fmt.Errorf(`--matrix requires a --boundary-report-file template such as "{{ .L.stage }}-{{ .L.region }}-boundary.json"`)
+		}
+		if boundaryReportT, err = template.New("boundaryReport").Option("missingkey=error").Parse(base.boundaryReportPath); err != nil {
+			return errors.WithMessage(err, "boundary report file template")
+		}
+	}
+
+	acs := make([]*appContext, len(combos))
+	paths := make(map[string]string)
+	for i, combo := range combos {
+		ac, err := base.withLocators(combo)
+		if err != nil {
+			return err
+		}
+		var b bytes.Buffer
+		if err := outputFileT.Execute(&b, &rsrcInfo{L: ac.locators}); err != nil {
+			return errors.WithMessage(err, "output file template")
+		}
+		ac.outputFilePath = b.String()
+		label := matrixLabel(ac.locators)
+		if other, ok := paths[ac.outputFilePath]; ok {
+			return fmt.Errorf(`matrix combinations %s and %s have the same output file "%s"`, other, label, ac.outputFilePath)
+		}
+		paths[ac.outputFilePath] = label
+		if boundaryReportT != nil {
+			b.Reset()
+			if err := boundaryReportT.Execute(&b, &rsrcInfo{L: ac.locators}); err != nil {
+				return errors.WithMessage(err, "boundary report file template")
+			}
+			ac.boundaryReportPath = b.String()
+			if other, ok := paths[ac.boundaryReportPath]; ok {
+				return fmt.Errorf(`matrix combinations %s and %s have the same output file "%s"`, other, label, ac.boundaryReportPath)
+			}
+			paths[ac.boundaryReportPath] = label
+		}
+		acs[i] = ac
+	}
+
+	outputs := make([]map[RsrcFullName][]byte, len(acs))
+	errs := make([]error, len(acs))
+	var wg sync.WaitGroup
+	for i, ac := range acs {
+		wg.Add(1)
+		go func(i int, ac *appContext) {
+			defer wg.Done()
+			outputs[i], errs[i] = ac.generate()
+		}(i, ac)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return errors.WithMessage(err, matrixLabel(acs[i].locators))
+		}
+	}
+
+	crossCheckMatrix(acs, outputs)
+	return nil
+}
+
+// crossCheckMatrix warns about resources whose policies differ between combinations.
+// Such a resource is shared by the combinations (e.g., a project shared by all
+// regions), so applying one combination's output would undo another's.
+func crossCheckMatrix(acs []*appContext, outputs []map[RsrcFullName][]byte) {
+	type variant struct {
+		output []byte
+		labels []string
+	}
+	variants := make(map[RsrcFullName][]*variant)
+	for i, output := range outputs {
+		label := matrixLabel(acs[i].locators)
+	nextRsrc:
+		for r, b := range output {
+			for _, v := range variants[r] {
+				if bytes.Equal(v.output, b) {
+					v.labels = append(v.labels, label)
+					continue nextRsrc
+				}
+			}
+			variants[r] = append(variants[r], &variant{output: b, labels: []string{label}})
+		}
+	}
+
+	keys := make([]string, 0, len(variants))
+	for r := range variants {
+		keys = append(keys, string(r))
+	}
+	sort.Strings(keys)
+	for _, r := range keys {
+		vs := variants[RsrcFullName(r)]
+		if len(vs) < 2 {
+			continue
+		}
+		var groups []string
+		for _, v := range vs {
+			groups = append(groups, strings.Join(v.labels, ","))
+		}
+		log.WithFields(log.Fields{
+			"resource":     r,
+			"combinations": groups,
+		}).Warn("matrix combinations disagree on shared resource policy")
+	}
+}
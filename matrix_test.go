@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseMatrix(t *testing.T) {
+	for _, tc := range []struct {
+		spec   string
+		labels []string // of the combinations, sorted
+		err    string   // expected in the error, if any
+	}{
+		{spec: "dev x usce1", labels: []string{"dev/usce1"}},
+		{spec: " dev, prod x usce1,euwe1 ", labels: []string{"dev/euwe1", "dev/usce1", "prod/euwe1", "prod/usce1"}},
+		{spec: "stg x euwe1 x core,billing", labels: []string{"stg/euwe1/billing", "stg/euwe1/core"}},
+		{spec: "dev", err: "malformed"},
+		{spec: "", err: "malformed"},
+		{spec: "dev x usce1 x core x more", err: "malformed"},
+		{spec: "devxusce1", err: "malformed"},
+		{spec: "dev,,prod x usce1", err: "empty stage"},
+		{spec: "dev x usce1, ", err: "empty region"},
+		{spec: "qa x usce1", err: "stage qa not supported"},
+		{spec: "dev x mars1", err: "region mars1 not supported"},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			combos, err := parseMatrix(tc.spec, "gcp")
+			if len(tc.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var labels []string
+			for _, combo := range combos {
+				labels = append(labels, matrixLabel(combo))
+			}
+			sort.Strings(labels)
+			if !reflect.DeepEqual(labels, tc.labels) {
+				t.Errorf("got combinations %v, want %v", labels, tc.labels)
+			}
+		})
+	}
+}
@@ -1,35 +1,293 @@
 package main
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+
 	log "github.com/sirupsen/logrus"
 )
 
-func (ac *appContext) deriveKSANames() error {
-	for nsName, appNames := range ac.apps {
-		for _, appName := range appNames {
-			ac.ksaNames[appName] = makeKSAName(nsName, appName)
+func (ac *appContext) deriveAppDecls() error {
+	for name, rb := range defaultRuntimes {
+		ac.runtimes[name] = rb
+	}
+	for name, rb := range ac.ru.Runtimes {
+		ac.runtimes[name] = rb
+	}
+
+	baselineRoles := defaultBaselineRoles
+	if ac.ru.BaselineRoles != nil {
+		baselineRoles = ac.ru.BaselineRoles
+	}
+	runtimeProject := makeRuntimeProjectName(ac.locators)
+	iamProject := makeIAMProjectName(ac.locators)
+
+	for nsName, ns := range ac.apps {
+		for _, appDecl := range ns.Apps {
+			if existing, ok := ac.appDecls[appDecl.Name]; ok {
+				return fmt.Errorf(`app "%s" declared in both namespace %s and %s`, appDecl.Name, existing.nsName, nsName)
+			}
+			appDecl.nsName = nsName
+			if len(appDecl.Runtime) == 0 {
+				appDecl.Runtime = ns.Runtime
+			}
+			if len(appDecl.Runtime) == 0 {
+				appDecl.Runtime = defaultRuntime
+			}
+			if len(appDecl.RuntimeProject) == 0 {
+				appDecl.RuntimeProject = ns.RuntimeProject
+			}
+			if len(appDecl.RuntimeProject) == 0 && appDecl.Runtime == "gke" {
+				// Only GKE apps have a default runtime project: the shared GKE project.
+				appDecl.RuntimeProject = runtimeProject
+			}
+			if appDecl.BaselineRoles == nil {
+				appDecl.BaselineRoles = ns.BaselineRoles
+			}
+			if appDecl.BaselineRoles == nil {
+				appDecl.BaselineRoles = baselineRoles
+			}
+			if len(appDecl.IAMProject) == 0 {
+				appDecl.IAMProject = ns.IAMProject
+			}
+			if len(appDecl.IAMProject) == 0 {
+				appDecl.IAMProject = iamProject
+			}
+			if len(appDecl.GSA) > 0 {
+				gsa, err := makeTemplatedProjectName(string(appDecl.GSA), string(appDecl.Name), ac.locators)
+				if err != nil {
+					return fmt.Errorf(`app "%s": gsa: %w`, appDecl.Name, err)
+				}
+				if !strings.Contains(gsa, "@") {
+					return fmt.Errorf(`app "%s": gsa %q is not an email address`, appDecl.Name, gsa)
+				}
+				appDecl.GSA = GSAName(gsa)
+			}
+			var err error
+			if appDecl.IAMProject, err = makeTemplatedProjectName(appDecl.IAMProject, string(appDecl.Name), ac.locators); err != nil {
+				return fmt.Errorf(`app "%s": iamProject: %w`, appDecl.Name, err)
+			}
+			if len(appDecl.RuntimeProject) > 0 {
+				if appDecl.RuntimeProject, err = makeTemplatedProjectName(appDecl.RuntimeProject, string(appDecl.Name), ac.locators); err != nil {
+					return fmt.Errorf(`app "%s": runtimeProject: %w`, appDecl.Name, err)
+				}
+			}
+			if _, ok := ac.runtimes[appDecl.Runtime]; !ok {
+				return fmt.Errorf(`app "%s": runtime %v not supported`, appDecl.Name, appDecl.Runtime)
+			}
+			ac.appDecls[appDecl.Name] = appDecl
 		}
 	}
 	return nil
 }
 
+func (ac *appContext) deriveKSANames() error {
+	for appName, appDecl := range ac.appDecls {
+		ac.ksaNames[appName] = makeKSAName(appDecl.nsName, appName)
+	}
+	return nil
+}
+
+// deriveGSANames derives each app's GSA. Apps may share a GSA only by declaring it
+// (see AppDecl.SharesGSAWith); any other apps whose GSAs would coincide are an error.
 func (ac *appContext) deriveGSANames() error {
-	for _, appNames := range ac.apps {
-		for _, appName := range appNames {
-			ac.gsaNames[appName] = makeGSAName(appName, ac.locators)
+	appNames := make([]string, 0, len(ac.appDecls))
+	for appName := range ac.appDecls {
+		appNames = append(appNames, string(appName))
+	}
+	sort.Strings(appNames)
+
+	gsaApps := make(map[GSAName]AppName)
+	for _, name := range appNames {
+		appName := AppName(name)
+		appDecl := ac.appDecls[appName]
+		if len(appDecl.SharesGSAWith) > 0 {
+			continue
+		}
+		gsaName := appDecl.GSA
+		if len(gsaName) == 0 {
+			gsaName = makeGSAName(appName, appDecl.IAMProject, ac.locators)
+		}
+		if other, ok := gsaApps[gsaName]; ok {
+			return fmt.Errorf(`apps "%s" and "%s" would share GSA %s; use sharesGSAWith to share it deliberately`, other, appName, gsaName)
+		}
+		gsaApps[gsaName] = appName
+		ac.gsaNames[appName] = gsaName
+	}
+
+	for _, name := range appNames {
+		appName := AppName(name)
+		appDecl := ac.appDecls[appName]
+		if len(appDecl.SharesGSAWith) == 0 {
+			continue
+		}
+		if len(appDecl.GSA) > 0 {
+			return fmt.Errorf(`app "%s": gsa and sharesGSAWith are mutually exclusive`, appName)
+		}
+		gsaName, ok := ac.gsaNames[appDecl.SharesGSAWith]
+		if !ok {
+			return fmt.Errorf(`app "%s" shares the GSA of "%s", which is not a declared app with a GSA of its own`, appName, appDecl.SharesGSAWith)
+		}
+		ac.gsaNames[appName] = gsaName
+	}
+	return nil
+}
+
+func (ac *appContext) deriveMembers() error {
+	for appName, gsaName := range ac.gsaNames {
+		ac.members[appName] = serviceAccountPrincipal(gsaName)
+	}
+
+	p := &ac.ru.Principals
+	for prefix, principals := range map[string]map[AppName]string{
+		"group":          p.Groups,
+		"user":           p.Users,
+		"serviceAccount": p.ServiceAccounts,
+		"principalSet":   p.PrincipalSets,
+	} {
+		for name, id := range principals {
+			if existing, ok := ac.members[name]; ok {
+				return fmt.Errorf(`principal name "%s" already used for %s`, name, existing)
+			}
+			if Principal(id).valid() {
+				return fmt.Errorf(`principal "%s": %q should not include its type`, name, id)
+			}
+			member := Principal(prefix + ":" + id)
+			if !member.valid() {
+				return fmt.Errorf(`principal "%s": %q is not a valid IAM member`, name, member)
+			}
+			ac.members[name] = member
+		}
+	}
+	return nil
+}
+
+// ownerProject returns the ID of the project owning resources declared under ownerKey
+// (given the resources' locators), from the owner registry if the owner is registered.
+func (ac *appContext) ownerProject(ownerKey RsrcOwnerKey, locators map[string]string) (string, error) {
+	ownerDecl, ok := ac.ru.Owners[ownerKey]
+	if !ok {
+		return makeProjectName(ownerKey, locators), nil
+	}
+	projectT := ownerDecl.Project
+	if t, ok := ownerDecl.Stages[locators["stage"]]; ok {
+		projectT = t
+	}
+	if len(projectT) == 0 {
+		return "", fmt.Errorf(`owner "%s" has no project for stage %s`, ownerKey, locators["stage"])
+	}
+	project, err := makeTemplatedProjectName(projectT, string(ownerKey), locators)
+	if err != nil {
+		return "", fmt.Errorf(`owner "%s": %w`, ownerKey, err)
+	}
+	return project, nil
+}
+
+// rsrcLocators returns the locators of a resource: the run's, except as overridden
+// by the resource's declaration. It also returns the overrides that differ from the
+// run's locators, as "name=value" strings, if the resource is across a boundary.
+func (ac *appContext) rsrcLocators(rsrcKind RsrcKind, rsrcDecl RsrcDecl) (map[string]string, []string, error) {
+	if len(rsrcDecl.Locators) == 0 {
+		return ac.locators, nil, nil
+	}
+	locators := make(map[string]string, len(ac.locators))
+	for k, v := range ac.locators {
+		locators[k] = v
+	}
+	var boundary []string
+	for k, v := range rsrcDecl.Locators {
+		if !rsrcLocatorOverrides[k] {
+			return nil, nil, fmt.Errorf(`%s resource "%s": locator %s cannot be overridden`, rsrcKind, rsrcDecl.Name, k)
+		}
+		if k == "stage" && !supportedLevels[v] {
+			return nil, nil, fmt.Errorf(`%s resource "%s": stage %v not supported`, rsrcKind, rsrcDecl.Name, v)
+		}
+		if v != ac.locators[k] {
+			boundary = append(boundary, k+"="+v)
+		}
+		locators[k] = v
+	}
+	sort.Strings(boundary)
+	return locators, boundary, nil
+}
+
+func (ac *appContext) deriveRsrcDeclFullNames(rsrcKind RsrcKind, ownerKey RsrcOwnerKey, rsrcDecl RsrcDecl) error {
+	if !ac.rsrcFullNames.supports(rsrcKind) {
+		return fmt.Errorf(`%s resource "%s": unsupported resource kind`, rsrcKind, rsrcDecl.Name)
+	}
+	locators, boundary, err := ac.rsrcLocators(rsrcKind, rsrcDecl)
+	if err != nil {
+		return err
+	}
+	project, err := ac.ownerProject(ownerKey, locators)
+	if err != nil {
+		return err
+	}
+	if _, ok := ac.rsrcDecls[rsrcKind]; !ok {
+		ac.rsrcDecls[rsrcKind] = make(map[RsrcName]RsrcDecl)
+	}
+	if _, ok := ac.rsrcDecls[rsrcKind][rsrcDecl.Name]; ok {
+		return fmt.Errorf(`%s resource "%s" has more than one declaration selected for this run`, rsrcKind, rsrcDecl.Name)
+	}
+	rsrcDecl.ownerKey, rsrcDecl.project, rsrcDecl.locators, rsrcDecl.boundary = ownerKey, project, locators, boundary
+	ac.rsrcDecls[rsrcKind][rsrcDecl.Name] = rsrcDecl
+
+	var entries []rsrcFullNameEntry
+	stage := locators["stage"]
+	if fullName, ok := rsrcDecl.FullNames[stage]; ok {
+		entries = makeLiteralFullNames(rsrcKind, rsrcDecl.Name, RsrcFullName(fullName))
+	} else if id, ok := rsrcDecl.IDs[stage]; ok {
+		if entries, ok = makeLiteralIDFullNames(rsrcKind, project, rsrcDecl.Name, id, locators); !ok {
+			return fmt.Errorf(`%s resource "%s": IDs not supported; use fullNames`, rsrcKind, rsrcDecl.Name)
 		}
+	} else if len(rsrcDecl.FullNames) > 0 || len(rsrcDecl.IDs) > 0 {
+		return fmt.Errorf(`%s resource "%s" has no name for stage %s`, rsrcKind, rsrcDecl.Name, stage)
+	} else {
+		entries = makeRsrcFullNames(rsrcKind, project, rsrcDecl.Name, locators)
+	}
+	for _, e := range entries {
+		ac.rsrcFullNames[e.rsrcKind][e.rsrcName] = e.rsrcFullName
 	}
 	return nil
 }
 
 func (ac *appContext) deriveRsrcFullNames() error {
 	for rsrcKind, ownedBy := range ac.ru.Resources {
-		for ownerKey, rsrcNames := range ownedBy {
-			for _, rsrcName := range rsrcNames {
-				entries := makeRsrcFullNames(rsrcKind, ownerKey, rsrcName, ac.locators)
-				for _, e := range entries {
-					ac.rsrcFullNames[e.rsrcKind][e.rsrcName] = e.rsrcFullName
+		for ownerKey, rsrcDecls := range ownedBy {
+			for _, rsrcDecl := range rsrcDecls {
+				if !rsrcDecl.selects(ac.locators) {
+					if ac.unselectedRsrcs[rsrcKind] == nil {
+						ac.unselectedRsrcs[rsrcKind] = make(map[RsrcName]bool)
+					}
+					ac.unselectedRsrcs[rsrcKind][rsrcDecl.Name] = true
+					continue
+				}
+				if err := ac.deriveRsrcDeclFullNames(rsrcKind, ownerKey, rsrcDecl); err != nil {
+					return err
+				}
+				if oidcApp := rsrcDecl.OIDCServiceAccount; rsrcKind == rkTasksQueues && len(oidcApp) > 0 {
+					if _, ok := ac.gsaNames[oidcApp]; !ok {
+						return fmt.Errorf(`%s resource "%s": OIDC service account %s is not a declared app`, rsrcKind, rsrcDecl.Name, oidcApp)
+					}
 				}
+				if rsrcKind == rkQueues && rsrcDecl.DeadLetter != nil {
+					// A queue's dead-letter queue is a queue in its own right.
+					dlqDecl := RsrcDecl{Name: deadLetterQueueName(rsrcDecl.Name), Locators: rsrcDecl.Locators}
+					if err := ac.deriveRsrcDeclFullNames(rsrcKind, ownerKey, dlqDecl); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	// A resource may have other declarations (e.g., for other stages) besides the
+	// one selected for this run; it is unselected only if none is selected.
+	for rsrcKind, rsrcNames := range ac.unselectedRsrcs {
+		for rsrcName := range rsrcNames {
+			if _, ok := ac.rsrcDecls[rsrcKind][rsrcName]; ok {
+				delete(rsrcNames, rsrcName)
 			}
 		}
 	}
@@ -45,6 +303,11 @@ func (ac *appContext) deriveRsrcFullNames() error {
 }
 
 func (ac *appContext) deriveNames() error {
+	if err := ac.deriveAppDecls(); err != nil {
+		return err
+	}
+	log.WithField("ac.appDecls", ac.appDecls).Debug("derived app declarations")
+
 	if err := ac.deriveKSANames(); err != nil {
 		return err
 	}
@@ -55,6 +318,11 @@ func (ac *appContext) deriveNames() error {
 	}
 	log.WithField("ac.gsaNames", ac.gsaNames).Debug("derived GSA names")
 
+	if err := ac.deriveMembers(); err != nil {
+		return err
+	}
+	log.WithField("ac.members", ac.members).Debug("derived members")
+
 	if err := ac.deriveRsrcFullNames(); err != nil {
 		return err
 	}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// OverlayUsage is the usage part of a resource usage file, as modified by an overlay.
+type OverlayUsage struct {
+	Usage          Usage
+	NamespaceUsage NamespaceUsage
+	NodeUsage      AppUsage
+}
+
+// OverlayAdditions are the declarations an overlay adds to a resource usage file.
+type OverlayAdditions struct {
+	OverlayUsage
+	Resources      Resources
+	Owners         Owners
+	Principals     Principals
+	ProjectNumbers ProjectNumbers
+}
+
+// UsageOverlay modifies a base resource usage file, so that (e.g.) each team can own
+// the usage of its apps, or a stage can differ from the others. Its operations are
+// applied in order:
+//
+//   - Remove: each listed usage entry is removed (by name) from its app, kind and
+//     operation. An operation, kind or app listed with no entries is removed entirely.
+//   - Replace: the entries of each listed app, kind and operation replace the base's.
+//   - Add: usage entries are appended to their app, kind and operation, and resources
+//     to their kind and owner. Resources, owners, principals and project numbers are
+//     added, but may not conflict with the base's; a resource may be added only for
+//     runs for which the base does not already declare it (see RsrcDecl).
+type UsageOverlay struct {
+	Remove  OverlayUsage
+	Replace OverlayUsage
+	Add     OverlayAdditions
+}
+
+// applyOverlay modifies ru by the given overlay, loaded from the named file.
+func (ru *ResourceUsage) applyOverlay(overlay *UsageOverlay, fileName string) error {
+	ru.applyOverlayUsage(overlay.Remove, removeAppUsage)
+	ru.applyOverlayUsage(overlay.Replace, replaceAppUsage)
+	ru.applyOverlayUsage(overlay.Add.OverlayUsage, addAppUsage)
+
+	if ru.Resources == nil {
+		ru.Resources = make(Resources)
+	}
+	declared := make(map[string]bool)
+	for rsrcKind, ownedBy := range ru.Resources {
+		for _, rsrcDecls := range ownedBy {
+			for _, rsrcDecl := range rsrcDecls {
+				declared[describeRsrcDecl(rsrcKind, rsrcDecl)] = true
+			}
+		}
+	}
+	for rsrcKind, ownedBy := range overlay.Add.Resources {
+		if ru.Resources[rsrcKind] == nil {
+			ru.Resources[rsrcKind] = make(map[RsrcOwnerKey][]RsrcDecl)
+		}
+		for ownerKey, rsrcDecls := range ownedBy {
+			for _, rsrcDecl := range rsrcDecls {
+				desc := describeRsrcDecl(rsrcKind, rsrcDecl)
+				if declared[desc] {
+					return fmt.Errorf(`%v: %v is already declared`, fileName, desc)
+				}
+				declared[desc] = true
+			}
+			ru.Resources[rsrcKind][ownerKey] = append(ru.Resources[rsrcKind][ownerKey], rsrcDecls...)
+		}
+	}
+
+	if ru.Owners == nil {
+		ru.Owners = make(Owners)
+	}
+	for ownerKey, ownerDecl := range overlay.Add.Owners {
+		if _, ok := ru.Owners[ownerKey]; ok {
+			return fmt.Errorf(`%v: owner %v is already registered`, fileName, ownerKey)
+		}
+		ru.Owners[ownerKey] = ownerDecl
+	}
+
+	for _, p := range []struct {
+		kind     string
+		dst, src *map[AppName]string
+	}{
+		{"group", &ru.Principals.Groups, &overlay.Add.Principals.Groups},
+		{"user", &ru.Principals.Users, &overlay.Add.Principals.Users},
+		{"service account", &ru.Principals.ServiceAccounts, &overlay.Add.Principals.ServiceAccounts},
+		{"principal set", &ru.Principals.PrincipalSets, &overlay.Add.Principals.PrincipalSets},
+	} {
+		if *p.dst == nil {
+			*p.dst = make(map[AppName]string)
+		}
+		for name, value := range *p.src {
+			if old, ok := (*p.dst)[name]; ok && old != value {
+				return fmt.Errorf(`%v: %v %v is already %v`, fileName, p.kind, name, old)
+			}
+			(*p.dst)[name] = value
+		}
+	}
+
+	if ru.ProjectNumbers == nil {
+		ru.ProjectNumbers = make(ProjectNumbers)
+	}
+	for project, number := range overlay.Add.ProjectNumbers {
+		if old, ok := ru.ProjectNumbers[project]; ok && old != number {
+			return fmt.Errorf(`%v: project %v already has number %v`, fileName, project, old)
+		}
+		ru.ProjectNumbers[project] = number
+	}
+	return nil
+}
+
+// applyOverlayUsage applies one overlay operation (f) to each part of ru's usage.
+func (ru *ResourceUsage) applyOverlayUsage(ou OverlayUsage, f func(dst, src AppUsage) AppUsage) {
+	if ru.Usage == nil {
+		ru.Usage = make(Usage)
+	}
+	for appName, appUsage := range ou.Usage {
+		if u := f(ru.Usage[appName], appUsage); u != nil {
+			ru.Usage[appName] = u
+		} else {
+			delete(ru.Usage, appName)
+		}
+	}
+	if ru.NamespaceUsage == nil {
+		ru.NamespaceUsage = make(NamespaceUsage)
+	}
+	for nsName, nsUsage := range ou.NamespaceUsage {
+		if u := f(ru.NamespaceUsage[nsName], nsUsage); u != nil {
+			ru.NamespaceUsage[nsName] = u
+		} else {
+			delete(ru.NamespaceUsage, nsName)
+		}
+	}
+	if ou.NodeUsage != nil {
+		ru.NodeUsage = f(ru.NodeUsage, ou.NodeUsage)
+	}
+}
+
+func addAppUsage(dst, src AppUsage) AppUsage {
+	if dst == nil {
+		dst = make(AppUsage)
+	}
+	for rsrcKind, rsrcKindUsage := range src {
+		if dst[rsrcKind] == nil {
+			dst[rsrcKind] = make(map[OperName][]UsageEntry)
+		}
+		for operName, usageEntries := range rsrcKindUsage {
+			dst[rsrcKind][operName] = append(dst[rsrcKind][operName], usageEntries...)
+		}
+	}
+	return dst
+}
+
+func replaceAppUsage(dst, src AppUsage) AppUsage {
+	if dst == nil {
+		dst = make(AppUsage)
+	}
+	for rsrcKind, rsrcKindUsage := range src {
+		if dst[rsrcKind] == nil {
+			dst[rsrcKind] = make(map[OperName][]UsageEntry)
+		}
+		for operName, usageEntries := range rsrcKindUsage {
+			dst[rsrcKind][operName] = usageEntries
+		}
+	}
+	return dst
+}
+
+// removeAppUsage returns nil if nothing remains of dst.
+func removeAppUsage(dst, src AppUsage) AppUsage {
+	if len(src) == 0 {
+		return nil
+	}
+	for rsrcKind, rsrcKindUsage := range src {
+		if len(rsrcKindUsage) == 0 {
+			delete(dst, rsrcKind)
+			continue
+		}
+		for operName, usageEntries := range rsrcKindUsage {
+			if len(usageEntries) > 0 {
+				usageEntries = removeUsageEntries(dst[rsrcKind][operName], usageEntries, rsrcKind, operName)
+			}
+			if len(usageEntries) > 0 {
+				dst[rsrcKind][operName] = usageEntries
+			} else {
+				delete(dst[rsrcKind], operName)
+			}
+		}
+		if len(dst[rsrcKind]) == 0 {
+			delete(dst, rsrcKind)
+		}
+	}
+	if len(dst) == 0 {
+		return nil
+	}
+	return dst
+}
+
+// removeUsageEntries returns the entries of dst not named in src.
+func removeUsageEntries(dst, src []UsageEntry, rsrcKind RsrcKind, operName OperName) []UsageEntry {
+	removed := make(map[RsrcName]bool, len(src))
+	for _, e := range src {
+		removed[e.Name] = false
+	}
+	var kept []UsageEntry
+	for _, e := range dst {
+		if _, ok := removed[e.Name]; ok {
+			removed[e.Name] = true
+			continue
+		}
+		kept = append(kept, e)
+	}
+	for rsrcName, found := range removed {
+		if !found {
+			log.WithFields(log.Fields{
+				"kind": rsrcKind,
+				"oper": operName,
+				"rsrc": rsrcName,
+			}).Warn("overlay removes usage entry not in base")
+		}
+	}
+	return kept
+}
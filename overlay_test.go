@@ -0,0 +1,214 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// entries returns usage entries naming the given resources.
+func entries(names ...RsrcName) []UsageEntry {
+	var es []UsageEntry
+	for _, name := range names {
+		es = append(es, UsageEntry{Name: name})
+	}
+	return es
+}
+
+func TestApplyOverlayUsage(t *testing.T) {
+	// base returns a fresh copy each time, since overlays modify it in place.
+	base := func() Usage {
+		return Usage{
+			"app": AppUsage{
+				rkBuckets: {
+					"read":  entries("b1", "b2"),
+					"write": entries("b1"),
+				},
+				rkTopics: {
+					"publish": entries("t1"),
+				},
+			},
+			"other": AppUsage{
+				rkTopics: {
+					"subscribe": entries("t1"),
+				},
+			},
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		overlay UsageOverlay
+		want    Usage
+	}{
+		{
+			name: "remove entry",
+			overlay: UsageOverlay{Remove: OverlayUsage{Usage: Usage{
+				"app": {rkBuckets: {"read": entries("b2")}},
+			}}},
+			want: Usage{
+				"app": {
+					rkBuckets: {"read": entries("b1"), "write": entries("b1")},
+					rkTopics:  {"publish": entries("t1")},
+				},
+				"other": {rkTopics: {"subscribe": entries("t1")}},
+			},
+		},
+		{
+			name: "remove entry not in base",
+			overlay: UsageOverlay{Remove: OverlayUsage{Usage: Usage{
+				"app": {rkTopics: {"publish": entries("t9")}},
+			}}},
+			want: base(),
+		},
+		{
+			name: "remove operation",
+			overlay: UsageOverlay{Remove: OverlayUsage{Usage: Usage{
+				"app": {rkBuckets: {"write": nil}},
+			}}},
+			want: Usage{
+				"app": {
+					rkBuckets: {"read": entries("b1", "b2")},
+					rkTopics:  {"publish": entries("t1")},
+				},
+				"other": {rkTopics: {"subscribe": entries("t1")}},
+			},
+		},
+		{
+			name: "remove kind",
+			overlay: UsageOverlay{Remove: OverlayUsage{Usage: Usage{
+				"app": {rkBuckets: nil},
+			}}},
+			want: Usage{
+				"app":   {rkTopics: {"publish": entries("t1")}},
+				"other": {rkTopics: {"subscribe": entries("t1")}},
+			},
+		},
+		{
+			name: "remove app",
+			overlay: UsageOverlay{Remove: OverlayUsage{Usage: Usage{
+				"other": nil,
+			}}},
+			want: Usage{
+				"app": base()["app"],
+			},
+		},
+		{
+			name: "remove last entry removes app",
+			overlay: UsageOverlay{Remove: OverlayUsage{Usage: Usage{
+				"other": {rkTopics: {"subscribe": entries("t1")}},
+			}}},
+			want: Usage{
+				"app": base()["app"],
+			},
+		},
+		{
+			name: "remove then add",
+			overlay: UsageOverlay{
+				Remove: OverlayUsage{Usage: Usage{
+					"app":   {rkBuckets: {"read": entries("b1", "b2")}},
+					"other": nil,
+				}},
+				Add: OverlayAdditions{OverlayUsage: OverlayUsage{Usage: Usage{
+					"app":   {rkBuckets: {"read": entries("b2")}},
+					"other": {rkBuckets: {"read": entries("b1")}},
+				}}},
+			},
+			want: Usage{
+				"app": {
+					rkBuckets: {"read": entries("b2"), "write": entries("b1")},
+					rkTopics:  {"publish": entries("t1")},
+				},
+				"other": {rkBuckets: {"read": entries("b1")}},
+			},
+		},
+		{
+			name: "replace then add",
+			overlay: UsageOverlay{
+				Replace: OverlayUsage{Usage: Usage{
+					"app": {rkBuckets: {"read": entries("b3")}},
+				}},
+				Add: OverlayAdditions{OverlayUsage: OverlayUsage{Usage: Usage{
+					"app": {rkBuckets: {"read": entries("b4")}},
+				}}},
+			},
+			want: Usage{
+				"app": {
+					rkBuckets: {"read": entries("b3", "b4"), "write": entries("b1")},
+					rkTopics:  {"publish": entries("t1")},
+				},
+				"other": {rkTopics: {"subscribe": entries("t1")}},
+			},
+		},
+		{
+			name: "add to new app",
+			overlay: UsageOverlay{Add: OverlayAdditions{OverlayUsage: OverlayUsage{Usage: Usage{
+				"new": {rkTopics: {"publish": entries("t2")}},
+			}}}},
+			want: func() Usage {
+				u := base()
+				u["new"] = AppUsage{rkTopics: {"publish": entries("t2")}}
+				return u
+			}(),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ru := &ResourceUsage{Usage: base()}
+			if err := ru.applyOverlay(&tc.overlay, "overlay.yaml"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(ru.Usage, tc.want) {
+				t.Errorf("got usage %v, want %v", ru.Usage, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplyOverlayConflicts(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		add  OverlayAdditions
+		err  string
+	}{
+		{
+			name: "resource",
+			add:  OverlayAdditions{Resources: Resources{rkBuckets: {"other": {{Name: "b1"}}}}},
+			err:  "overlay.yaml: buckets resource b1 is already declared",
+		},
+		{
+			name: "resource added twice",
+			add: OverlayAdditions{Resources: Resources{rkBuckets: {"core": {
+				{Name: "b2", Selector: Selector{Stages: []string{"prod"}}},
+				{Name: "b2", Selector: Selector{Stages: []string{"prod"}}},
+			}}}},
+			err: "overlay.yaml: buckets resource b2 for stages prod is already declared",
+		},
+		{
+			name: "owner",
+			add:  OverlayAdditions{Owners: Owners{"core": {Project: "other"}}},
+			err:  "overlay.yaml: owner core is already registered",
+		},
+		{
+			name: "principal",
+			add:  OverlayAdditions{Principals: Principals{Groups: map[AppName]string{"eng": "other@example.com"}}},
+			err:  "overlay.yaml: group eng is already eng@example.com",
+		},
+		{
+			name: "project number",
+			add:  OverlayAdditions{ProjectNumbers: ProjectNumbers{"p": "2"}},
+			err:  "overlay.yaml: project p already has number 1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ru := &ResourceUsage{
+				Resources:      Resources{rkBuckets: {"core": {{Name: "b1"}}}},
+				Owners:         Owners{"core": {Project: "core"}},
+				Principals:     Principals{Groups: map[AppName]string{"eng": "eng@example.com"}},
+				ProjectNumbers: ProjectNumbers{"p": "1"},
+			}
+			err := ru.applyOverlay(&UsageOverlay{Add: tc.add}, "overlay.yaml")
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("got error %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
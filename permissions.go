@@ -34,10 +34,122 @@ func (qp *QueuePermissions) GetRoles(operName OperName) (roles []IAMRole) {
 	return
 }
 
+type KMSKeyPermissions struct {
+	Encrypt []IAMRole
+	Decrypt []IAMRole
+	Sign    []IAMRole
+}
+
+func (kp *KMSKeyPermissions) GetRoles(operName OperName) (roles []IAMRole) {
+	switch operName {
+	case "encrypt":
+		roles = kp.Encrypt
+	case "decrypt":
+		roles = kp.Decrypt
+	case "sign":
+		roles = kp.Sign
+	default:
+		// complain
+	}
+	return
+}
+
+type ServicePermissions struct {
+	Invoke []IAMRole
+}
+
+func (sp *ServicePermissions) GetRoles(operName OperName) (roles []IAMRole) {
+	switch operName {
+	case "invoke":
+		roles = sp.Invoke
+	default:
+		// complain
+	}
+	return
+}
+
+type TaskQueuePermissions struct {
+	Enqueue []IAMRole
+	Manage  []IAMRole
+}
+
+func (tp *TaskQueuePermissions) GetRoles(operName OperName) (roles []IAMRole) {
+	switch operName {
+	case "enqueue":
+		roles = tp.Enqueue
+	case "manage":
+		roles = tp.Manage
+	default:
+		// complain
+	}
+	return
+}
+
+type RepositoryPermissions struct {
+	Pull []IAMRole
+	Push []IAMRole
+}
+
+func (rp *RepositoryPermissions) GetRoles(operName OperName) (roles []IAMRole) {
+	switch operName {
+	case "pull":
+		roles = rp.Pull
+	case "push":
+		roles = rp.Push
+	default:
+		// complain
+	}
+	return
+}
+
+type DatabasePermissions struct {
+	Read  []IAMRole
+	Write []IAMRole
+	Admin []IAMRole
+}
+
+func (dp *DatabasePermissions) GetRoles(operName OperName) (roles []IAMRole) {
+	switch operName {
+	case "read":
+		roles = dp.Read
+	case "write":
+		roles = dp.Write
+	case "admin":
+		roles = dp.Admin
+	default:
+		// complain
+	}
+	return
+}
+
+// spannerDatabaseRoleOperPrefix prefixes operations naming a Spanner fine-grained
+// database role, e.g. "role.analyst".
+const spannerDatabaseRoleOperPrefix = "role."
+
+// SpannerPermissions adds the roles needed for fine-grained access control:
+// FineGrained roles are granted on the database, and DatabaseRole roles are granted
+// conditionally on the named database role.
+type SpannerPermissions struct {
+	DatabasePermissions
+	FineGrained  []IAMRole
+	DatabaseRole []IAMRole
+}
+
 type Permissions struct {
-	Buckets             BucketPermissions `json:"buckets"`
-	QueuesTopics        QueuePermissions  `json:"queues.topics"`
-	QueuesSubscriptions QueuePermissions  `json:"queues.subscriptions"`
+	Buckets               BucketPermissions     `json:"buckets"`
+	QueuesTopics          QueuePermissions      `json:"queues.topics"`
+	QueuesSubscriptions   QueuePermissions      `json:"queues.subscriptions"`
+	Topics                QueuePermissions      `json:"topics"`
+	TopicsSubscriptions   QueuePermissions      `json:"topics.subscriptions"`
+	KMSKeys               KMSKeyPermissions     `json:"kms.keys"`
+	Services              ServicePermissions    `json:"services"`
+	Functions             ServicePermissions    `json:"functions"`
+	TasksQueues           TaskQueuePermissions  `json:"tasks.queues"`
+	ArtifactsRepositories RepositoryPermissions `json:"artifacts.repositories"`
+	SpannerDatabases      SpannerPermissions    `json:"spanner.databases"`
+	FirestoreDatabases    DatabasePermissions   `json:"firestore.databases"`
+	BigtableInstances     DatabasePermissions   `json:"bigtable.instances"`
+	BigtableTables        DatabasePermissions   `json:"bigtable.tables"`
 }
 
 func (p *Permissions) GetRoles(rsrcKind RsrcKind, operName OperName) (roles []IAMRole) {
@@ -48,6 +160,28 @@ func (p *Permissions) GetRoles(rsrcKind RsrcKind, operName OperName) (roles []IA
 		roles = p.QueuesTopics.GetRoles(operName)
 	case rkQueuesSubscriptions:
 		roles = p.QueuesSubscriptions.GetRoles(operName)
+	case rkTopics:
+		roles = p.Topics.GetRoles(operName)
+	case rkTopicsSubscriptions:
+		roles = p.TopicsSubscriptions.GetRoles(operName)
+	case rkKMSKeys:
+		roles = p.KMSKeys.GetRoles(operName)
+	case rkServices:
+		roles = p.Services.GetRoles(operName)
+	case rkFunctions:
+		roles = p.Functions.GetRoles(operName)
+	case rkTasksQueues:
+		roles = p.TasksQueues.GetRoles(operName)
+	case rkArtifactsRepositories:
+		roles = p.ArtifactsRepositories.GetRoles(operName)
+	case rkSpannerDatabases:
+		roles = p.SpannerDatabases.GetRoles(operName)
+	case rkFirestoreDatabases:
+		roles = p.FirestoreDatabases.GetRoles(operName)
+	case rkBigtableInstances:
+		roles = p.BigtableInstances.GetRoles(operName)
+	case rkBigtableTables:
+		roles = p.BigtableTables.GetRoles(operName)
 	default:
 		// complain
 	}
@@ -1,54 +1,476 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
-func (ac *appContext) walkRsrcKindAppUsage(appName AppName, rsrcKind RsrcKind, rsrcKindUsage map[OperName][]RsrcName) {
-	for operName, rsrcNames := range rsrcKindUsage {
-		for _, rsrcName := range rsrcNames {
-			log.WithFields(log.Fields{
-				"app":  appName,
-				"kind": rsrcKind,
-				"oper": operName,
-				"rsrc": rsrcName,
-			}).Debug("app resource usage")
+// crossBoundaryGrant records a grant of access to a resource of another company, unit
+// or stage (see RsrcDecl.Locators).
+type crossBoundaryGrant struct {
+	App      AppName  `json:"app"`
+	Kind     RsrcKind `json:"kind"`
+	Oper     OperName `json:"oper"`
+	Rsrc     RsrcName `json:"resource"`
+	Boundary []string `json:"boundary"` // the resource's locators that differ from the run's
+}
+
+// walkRsrcKindUsage grants member the roles needed for its usage of resources of
+// one kind. Usage is normally an app's own, in which case member is the app's GSA.
+func (ac *appContext) walkRsrcKindUsage(appName AppName, member Principal, rsrcKind RsrcKind, rsrcKindUsage map[OperName][]UsageEntry) {
+	for operName, usageEntries := range rsrcKindUsage {
+		for _, usageEntry := range usageEntries {
+			rsrcName := usageEntry.Name
+			condition := usageCondition(usageEntry)
+			entry := log.WithFields(log.Fields{
+				"app":       appName,
+				"kind":      rsrcKind,
+				"oper":      operName,
+				"rsrc":      rsrcName,
+				"condition": condition,
+			})
+			// Usage that is not selected for this run, or of a resource that is not,
+			// is simply left out.
+			if !usageEntry.selects(ac.locators) || ac.isUnselectedRsrc(rsrcKind, rsrcName) {
+				entry.Debug("skipping unselected app resource usage")
+				continue
+			}
+			entry.Debug("app resource usage")
+			rsrcDecl := ac.rsrcDecls[rsrcKind][declaredRsrcName(rsrcKind, rsrcName)]
+			if len(rsrcDecl.boundary) > 0 {
+				ac.crossBoundaryGrants = append(ac.crossBoundaryGrants, crossBoundaryGrant{
+					App:      appName,
+					Kind:     rsrcKind,
+					Oper:     operName,
+					Rsrc:     rsrcName,
+					Boundary: rsrcDecl.boundary,
+				})
+			}
 
 			switch rsrcKind {
+			case rkTasksQueues:
+				// Tasks carrying OIDC tokens can only be enqueued by callers that can act
+				// as the service account named in the tokens.
+				if oidcApp := rsrcDecl.OIDCServiceAccount; operName == "enqueue" && len(oidcApp) > 0 {
+					ac.rpm.AddConditional(ac.rsrcFullNames[rkServiceAccounts][RsrcName(oidcApp)],
+						[]IAMRole{"roles/iam.serviceAccountUser"},
+						condition,
+						member)
+				}
+				ac.rpm.AddConditional(ac.rsrcFullNames[rsrcKind][rsrcName],
+					ac.ru.Permissions.GetRoles(rsrcKind, operName),
+					condition,
+					member)
 			case "queues":
-				ac.rpm.Add(ac.rsrcFullNames[rkQueuesTopics][rsrcName],
+				ac.rpm.AddConditional(ac.rsrcFullNames[rkQueuesTopics][rsrcName],
 					ac.ru.Permissions.GetRoles(rkQueuesTopics, operName),
-					ac.gsaNames[appName])
-				ac.rpm.Add(ac.rsrcFullNames[rkQueuesSubscriptions][rsrcName],
+					condition,
+					member)
+				ac.rpm.AddConditional(ac.rsrcFullNames[rkQueuesSubscriptions][rsrcName],
 					ac.ru.Permissions.GetRoles(rkQueuesSubscriptions, operName),
-					ac.gsaNames[appName])
+					condition,
+					member)
+			case rkBuckets:
+				// "<bucket>/<prefix>[*]" limits access to objects whose names start
+				// with the prefix.
+				bucketName, prefix, ok := splitParentName(rsrcName)
+				if !ok {
+					ac.rpm.AddConditional(ac.rsrcFullNames[rsrcKind][rsrcName],
+						ac.ru.Permissions.GetRoles(rsrcKind, operName),
+						condition,
+						member)
+					break
+				}
+				bucketFullName := ac.rsrcFullNames[rsrcKind][RsrcName(bucketName)]
+				ac.rpm.AddConditional(bucketFullName,
+					ac.ru.Permissions.GetRoles(rsrcKind, operName),
+					andConditions(objectPrefixCondition(bucketFullName, strings.TrimSuffix(prefix, "*")), condition),
+					member)
+			case rkTopics:
+				// Each subscriber gets a subscription of its own, so that every
+				// subscriber receives every message.
+				if _, ok := ac.rsrcDecls[rkTopics][rsrcName]; !ok {
+					entry.Warn("usage of undeclared topic")
+					continue
+				}
+				ac.rpm.AddConditional(ac.rsrcFullNames[rkTopics][rsrcName],
+					ac.ru.Permissions.GetRoles(rkTopics, operName),
+					condition,
+					member)
+				if operName == "subscribe" {
+					ac.rpm.AddConditional(makeTopicSubscriptionFullName(rsrcDecl.project, rsrcName, appName, rsrcDecl.locators),
+						ac.ru.Permissions.GetRoles(rkTopicsSubscriptions, operName),
+						condition,
+						member)
+				}
+			case rkSpannerDatabases:
+				dbRole := strings.TrimPrefix(string(operName), spannerDatabaseRoleOperPrefix)
+				if dbRole == string(operName) {
+					ac.rpm.AddConditional(ac.rsrcFullNames[rsrcKind][rsrcName],
+						ac.ru.Permissions.GetRoles(rsrcKind, operName),
+						condition,
+						member)
+					break
+				}
+				dbFullName := ac.rsrcFullNames[rsrcKind][rsrcName]
+				ac.rpm.AddConditional(dbFullName,
+					ac.ru.Permissions.SpannerDatabases.FineGrained,
+					condition,
+					member)
+				ac.rpm.AddConditional(dbFullName,
+					ac.ru.Permissions.SpannerDatabases.DatabaseRole,
+					andConditions(spannerDatabaseRoleCondition(dbFullName, dbRole), condition),
+					member)
+			case rkFirestoreDatabases:
+				dbFullName := ac.rsrcFullNames[rsrcKind][rsrcName]
+				ac.rpm.AddConditional(projectFullName(dbFullName),
+					ac.ru.Permissions.GetRoles(rsrcKind, operName),
+					andConditions(firestoreDatabaseCondition(dbFullName), condition),
+					member)
+			case rkServices, rkFunctions:
+				// The invoked service is itself an app, running as its own GSA (unless it
+				// is another unit's, etc.).
+				if _, ok := ac.gsaNames[AppName(rsrcName)]; !ok && len(rsrcDecl.boundary) == 0 {
+					log.WithFields(log.Fields{
+						"app":  appName,
+						"kind": rsrcKind,
+						"rsrc": rsrcName,
+					}).Warn("invoked service is not a declared app")
+				}
+				fallthrough
 			default:
-				ac.rpm.Add(ac.rsrcFullNames[rsrcKind][rsrcName],
+				ac.rpm.AddConditional(ac.rsrcFullNames[rsrcKind][rsrcName],
 					ac.ru.Permissions.GetRoles(rsrcKind, operName),
-					ac.gsaNames[appName])
+					condition,
+					member)
 			}
 		}
 	}
 }
 
-func (ac *appContext) walkAppUsage(appName AppName, appUsage map[RsrcKind]map[OperName][]RsrcName) {
+// declaredRsrcName returns the declared name of the resource named in a usage entry.
+func declaredRsrcName(rsrcKind RsrcKind, rsrcName RsrcName) RsrcName {
+	if rsrcKind == rkBuckets {
+		if bucketName, _, ok := splitParentName(rsrcName); ok {
+			return RsrcName(bucketName)
+		}
+	}
+	return rsrcName
+}
+
+// isUnselectedRsrc reports whether the resource named in a usage entry is declared,
+// but not for this run's stage, region, etc.
+func (ac *appContext) isUnselectedRsrc(rsrcKind RsrcKind, rsrcName RsrcName) bool {
+	return ac.unselectedRsrcs[rsrcKind][declaredRsrcName(rsrcKind, rsrcName)]
+}
+
+func (ac *appContext) walkUsage(appName AppName, member Principal, appUsage AppUsage) {
 	for rsrcKind, rsrcKindUsage := range appUsage {
-		ac.walkRsrcKindAppUsage(appName, rsrcKind, rsrcKindUsage)
+		ac.walkRsrcKindUsage(appName, member, rsrcKind, rsrcKindUsage)
 	}
+}
 
-	// Add workload-identity role bindings to the app's GSA (as a resource). Secret squirrel stuff!!
+// addIdentityBindings adds the identity bindings required by the app's runtime to
+// the app's GSA (as a resource). Secret squirrel stuff!!
+func (ac *appContext) addIdentityBindings(appName AppName) {
+	rb := ac.runtimes[ac.appDecls[appName].Runtime]
 	ac.rpm.Add(ac.rsrcFullNames[rkServiceAccounts][RsrcName(appName)],
-		[]IAMRole{"roles/iam.serviceAccountTokenCreator"},
-		ac.gsaNames[appName])
+		rb.Self,
+		ac.members[appName])
 	ac.rpm.Add(ac.rsrcFullNames[rkServiceAccounts][RsrcName(appName)],
-		[]IAMRole{"roles/iam.workloadIdentityUser"},
-		makeGSAForKSAName(ac.ksaNames[appName], ac.locators))
+		rb.WorkloadIdentity,
+		serviceAccountPrincipal(makeGSAForKSAName(ac.ksaNames[appName], ac.appDecls[appName].RuntimeProject, ac.locators)))
+}
+
+// serviceAgentName returns the name of a Google-managed service agent acting for the
+// project owning a resource, if the project's number is known.
+func (ac *appContext) serviceAgentName(t *template.Template, rsrcDecl RsrcDecl, entry *log.Entry) (Principal, bool) {
+	projectName := rsrcDecl.project
+	projectNumber, ok := ac.ru.ProjectNumbers[projectName]
+	if !ok {
+		entry.WithField("project", projectName).Warn("no project number; skipping service agent binding")
+		return "", false
+	}
+	return serviceAccountPrincipal(makeServiceAgentName(t, projectNumber)), true
+}
+
+// deriveCMEKPolicies lets the Google-managed service agent of each CMEK-protected
+// resource's project use the resource's key. Without this binding, creating (or
+// writing to) the resource fails.
+func (ac *appContext) deriveCMEKPolicies() {
+	serviceAgentTs := map[RsrcKind]*template.Template{
+		rkBuckets: gcsServiceAgentT,
+		rkQueues:  pubsubServiceAgentT,
+		rkTopics:  pubsubServiceAgentT,
+	}
+	for rsrcKind, rsrcDecls := range ac.rsrcDecls {
+		serviceAgentT, ok := serviceAgentTs[rsrcKind]
+		if !ok {
+			continue
+		}
+		for _, rsrcDecl := range rsrcDecls {
+			if len(rsrcDecl.KMSKey) == 0 {
+				continue
+			}
+			entry := log.WithFields(log.Fields{
+				"kind":   rsrcKind,
+				"rsrc":   rsrcDecl.Name,
+				"kmsKey": rsrcDecl.KMSKey,
+			})
+			keyFullName, ok := ac.rsrcFullNames[rkKMSKeys][rsrcDecl.KMSKey]
+			if !ok {
+				entry.Warn("undeclared CMEK key")
+				continue
+			}
+			serviceAgent, ok := ac.serviceAgentName(serviceAgentT, rsrcDecl, entry)
+			if !ok {
+				continue
+			}
+			ac.rpm.Add(keyFullName,
+				[]IAMRole{"roles/cloudkms.cryptoKeyEncrypterDecrypter"},
+				serviceAgent)
+		}
+	}
+}
+
+// deriveDeadLetterPolicies lets the Pub/Sub service agent move undeliverable messages
+// from each queue with a dead-letter policy to its dead-letter queue. Without these
+// bindings, dead-lettering is silently disabled.
+func (ac *appContext) deriveDeadLetterPolicies() {
+	for _, rsrcDecl := range ac.rsrcDecls[rkQueues] {
+		if rsrcDecl.DeadLetter == nil {
+			continue
+		}
+		entry := log.WithFields(log.Fields{
+			"kind": rkQueues,
+			"rsrc": rsrcDecl.Name,
+		})
+		dlqName := deadLetterQueueName(rsrcDecl.Name)
+
+		if serviceAgent, ok := ac.serviceAgentName(pubsubServiceAgentT, rsrcDecl, entry); ok {
+			ac.rpm.Add(ac.rsrcFullNames[rkQueuesTopics][dlqName],
+				[]IAMRole{"roles/pubsub.publisher"},
+				serviceAgent)
+			ac.rpm.Add(ac.rsrcFullNames[rkQueuesSubscriptions][rsrcDecl.Name],
+				[]IAMRole{"roles/pubsub.subscriber"},
+				serviceAgent)
+		}
+
+		if operator := rsrcDecl.DeadLetter.Operator; len(operator) > 0 {
+			member, ok := ac.members[operator]
+			if !ok {
+				entry.WithField("operator", operator).Warn("dead-letter operator is not a declared app or principal")
+				continue
+			}
+			ac.walkRsrcKindUsage(operator, member, rkQueues, map[OperName][]UsageEntry{
+				"subscribe": {{Name: dlqName}},
+			})
+		}
+	}
+}
+
+// derivePushPolicies lets the push identity of each push subscription invoke the
+// receiving service, and lets the Pub/Sub service agent mint OIDC tokens for the push
+// identity.
+func (ac *appContext) derivePushPolicies() {
+	for _, rsrcDecl := range ac.rsrcDecls[rkQueues] {
+		if rsrcDecl.Push == nil {
+			continue
+		}
+		entry := log.WithFields(log.Fields{
+			"kind":    rkQueues,
+			"rsrc":    rsrcDecl.Name,
+			"service": rsrcDecl.Push.Service,
+		})
+		pushApp := rsrcDecl.Push.ServiceAccount
+		if len(pushApp) == 0 {
+			pushApp = AppName(rsrcDecl.Push.Service)
+		}
+		gsaName, ok := ac.gsaNames[pushApp]
+		if !ok {
+			entry.WithField("serviceAccount", pushApp).Warn("push identity is not a declared app")
+			continue
+		}
+		serviceFullName, ok := ac.rsrcFullNames[rkServices][rsrcDecl.Push.Service]
+		if !ok {
+			entry.Warn("undeclared push service")
+			continue
+		}
+
+		ac.rpm.Add(serviceFullName,
+			ac.ru.Permissions.GetRoles(rkServices, "invoke"),
+			serviceAccountPrincipal(gsaName))
+		if serviceAgent, ok := ac.serviceAgentName(pubsubServiceAgentT, rsrcDecl, entry); ok {
+			ac.rpm.Add(ac.rsrcFullNames[rkServiceAccounts][RsrcName(pushApp)],
+				[]IAMRole{"roles/iam.serviceAccountTokenCreator"},
+				serviceAgent)
+		}
+	}
+}
+
+// deriveNotificationPolicies configures object change notifications for buckets that
+// declare them, and lets the Cloud Storage service agent of each such bucket's project
+// publish to the notification topics.
+func (ac *appContext) deriveNotificationPolicies() {
+	for _, rsrcDecl := range ac.rsrcDecls[rkBuckets] {
+		for _, n := range rsrcDecl.Notifications {
+			entry := log.WithFields(log.Fields{
+				"kind":  rkBuckets,
+				"rsrc":  rsrcDecl.Name,
+				"topic": n.Topic,
+			})
+			topicFullName, ok := ac.rsrcFullNames[rkQueuesTopics][n.Topic]
+			if !ok {
+				topicFullName, ok = ac.rsrcFullNames[rkTopics][n.Topic]
+			}
+			if !ok {
+				entry.Warn("undeclared notification topic")
+				continue
+			}
+			ac.rpm.AddNotification(ac.rsrcFullNames[rkBuckets][rsrcDecl.Name], &BucketNotification{
+				Topic:            topicFullName,
+				EventTypes:       n.EventTypes,
+				ObjectNamePrefix: n.ObjectNamePrefix,
+				PayloadFormat:    "JSON_API_V1",
+			})
+			if serviceAgent, ok := ac.serviceAgentName(gcsServiceAgentT, rsrcDecl, entry); ok {
+				ac.rpm.Add(topicFullName,
+					[]IAMRole{"roles/pubsub.publisher"},
+					serviceAgent)
+			}
+		}
+	}
+}
+
+// deriveDeployerPolicies lets each namespace's deployer act as the namespace's apps'
+// GSAs, which it must do to deploy workloads running as them.
+func (ac *appContext) deriveDeployerPolicies() {
+	for _, ns := range ac.apps {
+		if len(ns.Deployer) == 0 {
+			continue
+		}
+		for _, appDecl := range ns.Apps {
+			ac.rpm.Add(ac.rsrcFullNames[rkServiceAccounts][RsrcName(appDecl.Name)],
+				[]IAMRole{"roles/iam.serviceAccountUser"},
+				ns.Deployer)
+		}
+	}
+}
+
+// reportCrossBoundaryGrants reports each grant of access to a resource of another
+// company, unit or stage, sorted by app, kind, resource and operation: to the
+// cross-boundary report file as newline-delimited JSON, if there is one, or else as
+// warnings.
+func (ac *appContext) reportCrossBoundaryGrants() error {
+	grants := make([]crossBoundaryGrant, len(ac.crossBoundaryGrants))
+	copy(grants, ac.crossBoundaryGrants)
+	sort.Slice(grants, func(i, j int) bool {
+		gi, gj := grants[i], grants[j]
+		if gi.App != gj.App {
+			return gi.App < gj.App
+		}
+		if gi.Kind != gj.Kind {
+			return gi.Kind < gj.Kind
+		}
+		if gi.Rsrc != gj.Rsrc {
+			return gi.Rsrc < gj.Rsrc
+		}
+		return gi.Oper < gj.Oper
+	})
+
+	if len(ac.boundaryReportPath) == 0 {
+		for _, g := range grants {
+			log.WithFields(log.Fields{
+				"app":      g.App,
+				"kind":     g.Kind,
+				"oper":     g.Oper,
+				"rsrc":     g.Rsrc,
+				"boundary": strings.Join(g.Boundary, ","),
+			}).Warn("cross-boundary grant")
+		}
+		return nil
+	}
+
+	f, err := os.OpenFile(ac.boundaryReportPath, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.WithError(err).Errorf("%s: error opening file", ac.boundaryReportPath)
+		return err
+	}
+	defer f.Close()
+	writer := bufio.NewWriter(f)
+	encoder := json.NewEncoder(writer)
+	for _, g := range grants {
+		if err := encoder.Encode(&g); err != nil {
+			return errors.WithMessage(err, ac.boundaryReportPath)
+		}
+	}
+	return writer.Flush()
 }
 
 func (ac *appContext) derivePolicies() error {
 	for appName, appUsage := range ac.ru.Usage {
-		ac.walkAppUsage(appName, appUsage)
+		member, ok := ac.members[appName]
+		if !ok {
+			log.WithField("app", appName).Warn("usage for undeclared app or principal")
+			continue
+		}
+		ac.walkUsage(appName, member, appUsage)
 	}
+
+	// Every declared app needs its identity bindings, whether or not it uses any
+	// resources yet; otherwise it cannot even authenticate. Apps sharing a GSA share
+	// their usage, so an app is unused only if no app with its GSA has any usage.
+	usedGSAs := make(map[GSAName]bool)
+	for appName, appDecl := range ac.appDecls {
+		ac.addIdentityBindings(appName)
+		if len(appDecl.RuntimeProject) > 0 {
+			ac.rpm.Add(RsrcFullName("projects/"+appDecl.RuntimeProject),
+				appDecl.BaselineRoles,
+				ac.members[appName])
+		}
+		_, hasUsage := ac.ru.Usage[appName]
+		_, hasNSUsage := ac.ru.NamespaceUsage[appDecl.nsName]
+		if hasUsage || hasNSUsage {
+			usedGSAs[ac.gsaNames[appName]] = true
+		}
+	}
+	var unusedApps []string
+	for appName := range ac.appDecls {
+		if !usedGSAs[ac.gsaNames[appName]] {
+			unusedApps = append(unusedApps, string(appName))
+		}
+	}
+	if len(unusedApps) > 0 {
+		sort.Strings(unusedApps)
+		log.WithField("apps", unusedApps).Warn("apps with no resource usage")
+	}
+
+	// Usage declared for a namespace applies to each of the namespace's apps.
+	for nsName, nsUsage := range ac.ru.NamespaceUsage {
+		ns, ok := ac.apps[nsName]
+		if !ok {
+			log.WithField("namespace", nsName).Warn("namespace usage for undeclared namespace")
+		}
+		for _, appDecl := range ns.Apps {
+			ac.walkUsage(appDecl.Name, ac.members[appDecl.Name], nsUsage)
+		}
+	}
+
+	// Usage declared for GKE nodes (e.g., image pulls) is granted to the node GSA.
+	ac.walkUsage(gkeNodesAppName, serviceAccountPrincipal(makeGKENodeGSAName(ac.locators)), ac.ru.NodeUsage)
+
+	ac.deriveDeployerPolicies()
+	ac.deriveCMEKPolicies()
+	ac.deriveDeadLetterPolicies()
+	ac.derivePushPolicies()
+	ac.deriveNotificationPolicies()
 	log.WithField("ac.rpm", ac.rpm).Debug("derived policies")
 	return nil
 }
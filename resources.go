@@ -14,18 +14,31 @@ import (
 type rsrcInfo struct {
 	Project string
 	Kind    string
+	Parent  string
 	Name    string
 	L       map[string]string
 }
 
 const (
 	gsaUsernamePattern = "^[a-z](?:[-a-z0-9]{4,28}[a-z0-9])$"
-
-	rkBuckets             RsrcKind = "buckets"
-	rkQueues              RsrcKind = "queues"
-	rkQueuesTopics        RsrcKind = "queues.topics"
-	rkQueuesSubscriptions RsrcKind = "queues.subscriptions"
-	rkServiceAccounts     RsrcKind = "serviceAccounts"
+	gsaDomainSuffix    = ".iam.gserviceaccount.com"
+
+	rkBuckets               RsrcKind = "buckets"
+	rkQueues                RsrcKind = "queues"
+	rkQueuesTopics          RsrcKind = "queues.topics"
+	rkQueuesSubscriptions   RsrcKind = "queues.subscriptions"
+	rkTopics                RsrcKind = "topics"
+	rkTopicsSubscriptions   RsrcKind = "topics.subscriptions"
+	rkServiceAccounts       RsrcKind = "serviceAccounts"
+	rkKMSKeys               RsrcKind = "kms.keys"
+	rkServices              RsrcKind = "services"
+	rkFunctions             RsrcKind = "functions"
+	rkTasksQueues           RsrcKind = "tasks.queues"
+	rkArtifactsRepositories RsrcKind = "artifacts.repositories"
+	rkSpannerDatabases      RsrcKind = "spanner.databases"
+	rkFirestoreDatabases    RsrcKind = "firestore.databases"
+	rkBigtableInstances     RsrcKind = "bigtable.instances"
+	rkBigtableTables        RsrcKind = "bigtable.tables"
 )
 
 func saUsername(appName AppName) string {
@@ -53,23 +66,43 @@ func makeKSAName(nsName NSName, appName AppName) KSAName {
 //
 // Also note that explicit project name prefixes ("owner keys") might not be appropriate
 // in project ID templates even if they are user-defined depending on the user's projects'
-// naming conventions, or lack thereof. (See related comment in makeQueueFullNames.)
+// naming conventions, or lack thereof; such owners can be registered instead. (See related
+// comment in makeProjectName.)
 const (
-	gsaNameTText       = "{{ .Name }}@iam-shr-{{ .L.stage }}-{{ .L.unit }}.iam.gserviceaccount.com"
-	gsaForKSANameTText = "gke-shr-{{ .L.stage }}-{{ .L.unit }}.svc.id.goog[{{ .Name }}]"
-	gsaFullNameTText   = "projects/iam-shr-{{ .L.stage }}-{{ .L.unit }}/serviceAccounts/{{ .Name }}"
+	iamProjectTText     = "iam-shr-{{ .L.stage }}-{{ .L.unit }}"
+	gsaNameTText        = "{{ .Name }}@{{ .Project }}.iam.gserviceaccount.com"
+	gsaForKSANameTText  = "{{ .Project }}.svc.id.goog[{{ .Name }}]"
+	gsaFullNameTText    = "projects/{{ .Project }}/serviceAccounts/{{ .Name }}"
+	gkeNodeGSANameTText = "{{ .Name }}@gke-shr-{{ .L.stage }}-{{ .L.unit }}.iam.gserviceaccount.com"
+	runtimeProjectTText = "gke-shr-{{ .L.stage }}-{{ .L.unit }}"
 )
 
 var (
+	iamProjectT = template.Must(
+		template.New("iamProject").Option("missingkey=error").Parse(iamProjectTText))
 	gsaNameT = template.Must(
 		template.New("gsaName").Option("missingkey=error").Parse(gsaNameTText))
 	gsaForKSANameT = template.Must(
 		template.New("gsaForKSAName").Option("missingkey=error").Parse(gsaForKSANameTText))
 	gsaFullNameT = template.Must(
 		template.New("gsaFullName").Option("missingkey=error").Parse(gsaFullNameTText))
+	gkeNodeGSANameT = template.Must(
+		template.New("gkeNodeGSAName").Option("missingkey=error").Parse(gkeNodeGSANameTText))
+	runtimeProjectT = template.Must(
+		template.New("runtimeProject").Option("missingkey=error").Parse(runtimeProjectTText))
 )
 
-func makeGSAName(appName AppName, locators map[string]string) GSAName {
+// makeIAMProjectName returns the ID of the project apps' GSAs are created in by default.
+func makeIAMProjectName(locators map[string]string) string {
+	var b bytes.Buffer
+	dot := rsrcInfo{L: locators}
+	if err := iamProjectT.Execute(&b, &dot); err != nil {
+		log.WithError(err).Fatal("iamProjectT.Execute")
+	}
+	return b.String()
+}
+
+func makeGSAName(appName AppName, project string, locators map[string]string) GSAName {
 	gsaUsername := saUsername(appName)
 	if strings.HasPrefix(gsaUsername, "scheduled-") {
 		gsaUsername = strings.Replace(gsaUsername, "scheduled-", "s-", 1)
@@ -86,40 +119,94 @@ func makeGSAName(appName AppName, locators map[string]string) GSAName {
 	}
 
 	var b bytes.Buffer
-	dot := rsrcInfo{Name: string(gsaUsername), L: locators}
+	dot := rsrcInfo{Project: project, Name: string(gsaUsername), L: locators}
 	if err := gsaNameT.Execute(&b, &dot); err != nil {
 		log.WithError(err).WithField("gsaUsername", gsaUsername).Fatal("gsaNameT.Execute")
 	}
 	return GSAName(b.String())
 }
 
-func makeGSAForKSAName(ksaName KSAName, locators map[string]string) GSAName {
+// makeGSAForKSAName returns the workload identity of a KSA in the workload identity
+// pool of the GKE project it runs in.
+func makeGSAForKSAName(ksaName KSAName, project string, locators map[string]string) GSAName {
 	var b bytes.Buffer
-	dot := rsrcInfo{Name: string(ksaName), L: locators}
+	dot := rsrcInfo{Project: project, Name: string(ksaName), L: locators}
 	if err := gsaForKSANameT.Execute(&b, &dot); err != nil {
 		log.WithError(err).WithField("ksaName", ksaName).Fatal("gsaForKSANameT.Execute")
 	}
 	return GSAName(b.String())
 }
 
+// makeGSAFullName returns the full name of a GSA, in the project named by its email
+// address if it is a user-managed GSA, or else in the "-" wildcard project.
 func makeGSAFullName(gsaName GSAName, locators map[string]string) RsrcFullName {
+	project := "-"
+	if _, domain, ok := strings.Cut(string(gsaName), "@"); ok && strings.HasSuffix(domain, gsaDomainSuffix) {
+		project = strings.TrimSuffix(domain, gsaDomainSuffix)
+	}
 	var b bytes.Buffer
-	dot := rsrcInfo{Name: string(gsaName), L: locators}
+	dot := rsrcInfo{Project: project, Name: string(gsaName), L: locators}
 	if err := gsaFullNameT.Execute(&b, &dot); err != nil {
 		log.WithError(err).WithField("gsaName", gsaName).Fatal("gsaFullNameT.Execute")
 	}
 	return RsrcFullName(b.String())
 }
 
+// makeRuntimeProjectName returns the ID of the project apps run in by default.
+func makeRuntimeProjectName(locators map[string]string) string {
+	var b bytes.Buffer
+	dot := rsrcInfo{L: locators}
+	if err := runtimeProjectT.Execute(&b, &dot); err != nil {
+		log.WithError(err).Fatal("runtimeProjectT.Execute")
+	}
+	return b.String()
+}
+
+func serviceAccountPrincipal(gsaName GSAName) Principal {
+	return Principal("serviceAccount:" + gsaName)
+}
+
+// gkeNodesAppName stands in for an app name when walking the GKE nodes' usage.
+const gkeNodesAppName AppName = "gke-nodes"
+
+func makeGKENodeGSAName(locators map[string]string) GSAName {
+	var b bytes.Buffer
+	dot := rsrcInfo{Name: string(gkeNodesAppName), L: locators}
+	if err := gkeNodeGSANameT.Execute(&b, &dot); err != nil {
+		log.WithError(err).Fatal("gkeNodeGSANameT.Execute")
+	}
+	return GSAName(b.String())
+}
+
 type RsrcFullNameMap map[RsrcKind]map[RsrcName]RsrcFullName
 
 func newRsrcFullNameMap() RsrcFullNameMap {
 	return RsrcFullNameMap{
-		rkBuckets:             map[RsrcName]RsrcFullName{},
-		rkQueuesTopics:        map[RsrcName]RsrcFullName{},
-		rkQueuesSubscriptions: map[RsrcName]RsrcFullName{},
-		rkServiceAccounts:     map[RsrcName]RsrcFullName{},
+		rkBuckets:               map[RsrcName]RsrcFullName{},
+		rkQueuesTopics:          map[RsrcName]RsrcFullName{},
+		rkQueuesSubscriptions:   map[RsrcName]RsrcFullName{},
+		rkTopics:                map[RsrcName]RsrcFullName{},
+		rkServiceAccounts:       map[RsrcName]RsrcFullName{},
+		rkKMSKeys:               map[RsrcName]RsrcFullName{},
+		rkServices:              map[RsrcName]RsrcFullName{},
+		rkFunctions:             map[RsrcName]RsrcFullName{},
+		rkTasksQueues:           map[RsrcName]RsrcFullName{},
+		rkArtifactsRepositories: map[RsrcName]RsrcFullName{},
+		rkSpannerDatabases:      map[RsrcName]RsrcFullName{},
+		rkFirestoreDatabases:    map[RsrcName]RsrcFullName{},
+		rkBigtableInstances:     map[RsrcName]RsrcFullName{},
+		rkBigtableTables:        map[RsrcName]RsrcFullName{},
+	}
+}
+
+// supports reports whether resources of the given kind can be declared. A queue's
+// full names are those of its topic and its subscription.
+func (m RsrcFullNameMap) supports(rsrcKind RsrcKind) bool {
+	if rsrcKind == rkQueues {
+		return true
 	}
+	_, ok := m[rsrcKind]
+	return ok
 }
 
 func (m RsrcFullNameMap) get(rsrcKind RsrcKind, rsrcName RsrcName) RsrcFullName {
@@ -132,12 +219,24 @@ type rsrcFullNameEntry struct {
 	rsrcFullName RsrcFullName
 }
 
-func makeRsrcFullNames(rsrcKind RsrcKind, ownerKey RsrcOwnerKey, rsrcName RsrcName, locators map[string]string) (entries []rsrcFullNameEntry) {
+func makeRsrcFullNames(rsrcKind RsrcKind, project string, rsrcName RsrcName, locators map[string]string) (entries []rsrcFullNameEntry) {
 	switch rsrcKind {
 	case rkBuckets:
-		return makeBucketFullNames(ownerKey, rsrcName, locators)
+		return makeBucketFullNames(project, rsrcName, locators)
 	case rkQueues:
-		return makeQueueFullNames(ownerKey, rsrcName, locators)
+		return makeQueueFullNames(project, rsrcName, locators)
+	case rkTopics:
+		return makeTopicFullNames(project, rsrcName, locators)
+	case rkKMSKeys:
+		return makeKMSKeyFullNames(project, rsrcName, locators)
+	case rkServices, rkFunctions:
+		return makeRegionalFullNames(rsrcKind, string(rsrcKind), project, rsrcName, locators)
+	case rkTasksQueues:
+		return makeRegionalFullNames(rsrcKind, "queues", project, rsrcName, locators)
+	case rkArtifactsRepositories:
+		return makeRepositoryFullNames(project, rsrcName, locators)
+	case rkSpannerDatabases, rkFirestoreDatabases, rkBigtableInstances, rkBigtableTables:
+		return makeDatabaseFullNames(rsrcKind, project, rsrcName, locators)
 	default:
 		// complain
 		return nil
@@ -156,7 +255,7 @@ var (
 		template.New("bucketFullName").Option("missingkey=error").Parse(bucketFullNameTText))
 )
 
-func makeBucketFullNames(_ RsrcOwnerKey, name RsrcName, locators map[string]string) []rsrcFullNameEntry {
+func makeBucketFullNames(_ string, name RsrcName, locators map[string]string) []rsrcFullNameEntry {
 	entry := log.WithField("name", name)
 
 	var b bytes.Buffer
@@ -195,7 +294,40 @@ var (
 		template.New("pubsubFullName").Option("missingkey=error").Parse(pubsubFullNameTText))
 )
 
-func makeQueueFullNames(owner RsrcOwnerKey, name RsrcName, locators map[string]string) []rsrcFullNameEntry {
+// makeProjectName returns the ID of the project owning resources declared under owner,
+// unless the owner is in the owner registry (see OwnerDecl and makeTemplatedProjectName).
+//
+// NOTE: Here we are taking advantage of the fact that, under our current naming convention,
+// the "resource owner" key is in fact the prefix of the owning project ID, and thus
+// directly consumable by the template (or part of a template) that constructs the
+// project ID. Owners whose projects do not follow the convention (e.g., legacy
+// projects) must be registered.
+func makeProjectName(owner RsrcOwnerKey, locators map[string]string) string {
+	var b bytes.Buffer
+	dot := rsrcInfo{Name: string(owner), L: locators}
+	if err := projectNameT.Execute(&b, &dot); err != nil {
+		log.WithError(err).WithField("owner", owner).Fatal("projectNameT.Execute")
+	}
+	return b.String()
+}
+
+// makeTemplatedProjectName expands a user-supplied project ID (or other name) template,
+// such as that of a registered owner, in which {{ .Name }} is the owner key (or app
+// name).
+func makeTemplatedProjectName(projectTText string, name string, locators map[string]string) (string, error) {
+	t, err := template.New("project").Option("missingkey=error").Parse(projectTText)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	dot := rsrcInfo{Name: name, L: locators}
+	if err := t.Execute(&b, &dot); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func makeQueueFullNames(project string, name RsrcName, locators map[string]string) []rsrcFullNameEntry {
 	entry := log.WithField("name", name)
 
 	var b bytes.Buffer
@@ -206,21 +338,7 @@ func makeQueueFullNames(owner RsrcOwnerKey, name RsrcName, locators map[string]s
 	pubsubName := b.String()
 
 	b.Reset()
-	// NOTE: Here we are taking advantage of the fact that, under our current naming convention,
-	//       the "resource owner" key is in fact the prefix of the owning project ID, and thus
-	//       directly consumable by the template (or part of a template) that constructs the
-	//       project ID. In a more general setting (e.g., working with legacy project IDs),
-	//       this may not be the case, and some sort of lookup or other mapping might be needed
-	//       to get the project ID (or the correct template for constructing the project ID).
-	//       Similar observations apply to other resource types as well (e.g., buckets).
-	dot.Name = string(owner)
-	if err := projectNameT.Execute(&b, &dot); err != nil {
-		entry.WithError(err).Fatal("projectNameT.Execute")
-	}
-	projectName := b.String()
-
-	b.Reset()
-	dot.Project, dot.Kind, dot.Name = projectName, "topics", pubsubName
+	dot.Project, dot.Kind, dot.Name = project, "topics", pubsubName
 	if err := pubsubFullNameT.Execute(&b, &dot); err != nil {
 		entry.WithError(err).Fatal("pubsubFullNameT.Execute(topics)")
 	}
@@ -246,3 +364,290 @@ func makeQueueFullNames(owner RsrcOwnerKey, name RsrcName, locators map[string]s
 		},
 	}
 }
+
+func deadLetterQueueName(name RsrcName) RsrcName {
+	return name + ".dlq"
+}
+
+func makePubsubFullName(project, kind, name string, locators map[string]string) RsrcFullName {
+	entry := log.WithField("name", name)
+
+	var b bytes.Buffer
+	dot := rsrcInfo{Name: name, L: locators}
+	if err := pubsubNameT.Execute(&b, &dot); err != nil {
+		entry.WithError(err).Fatal("pubsubNameT.Execute")
+	}
+	pubsubName := b.String()
+
+	b.Reset()
+	dot.Project, dot.Kind, dot.Name = project, kind, pubsubName
+	if err := pubsubFullNameT.Execute(&b, &dot); err != nil {
+		entry.WithError(err).Fatalf("pubsubFullNameT.Execute(%s)", kind)
+	}
+	return RsrcFullName(b.String())
+}
+
+// Unlike a queue, a topic has no subscription of its own; instead each subscribing
+// app gets its own subscription (see makeTopicSubscriptionFullName).
+func makeTopicFullNames(project string, name RsrcName, locators map[string]string) []rsrcFullNameEntry {
+	return []rsrcFullNameEntry{
+		{
+			rsrcKind:     rkTopics,
+			rsrcName:     name,
+			rsrcFullName: makePubsubFullName(project, "topics", string(name), locators),
+		},
+	}
+}
+
+// makeTopicSubscriptionFullName names the subscription through which an app
+// consumes a topic: "<topic>.<app>", suffixed like any other Pub/Sub name.
+func makeTopicSubscriptionFullName(project string, topic RsrcName, appName AppName, locators map[string]string) RsrcFullName {
+	return makePubsubFullName(project, "subscriptions", string(topic)+"."+string(appName), locators)
+}
+
+// splitParentName splits a resource name of the form "<parent>/<child>".
+func splitParentName(name RsrcName) (parent, child string, ok bool) {
+	parts := strings.SplitN(string(name), "/", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// projectFullName returns the full name of the project containing a resource.
+func projectFullName(rsrcFullName RsrcFullName) RsrcFullName {
+	parts := strings.SplitN(string(rsrcFullName), "/", 3)
+	if len(parts) < 2 || parts[0] != "projects" {
+		log.WithField("rsrcFullName", rsrcFullName).Error("not a project-scoped resource name")
+		return ""
+	}
+	return RsrcFullName("projects/" + parts[1])
+}
+
+// KMS keys are declared as "<keyRing>/<cryptoKey>"; the key ring lives in the
+// owner's project at the location corresponding to the current region.
+const kmsKeyFullNameTText = "projects/{{ .Project }}/locations/{{ .L.location }}/keyRings/{{ .Parent }}/cryptoKeys/{{ .Name }}"
+
+var kmsKeyFullNameT = template.Must(
+	template.New("kmsKeyFullName").Option("missingkey=error").Parse(kmsKeyFullNameTText))
+
+func makeKMSKeyFullNames(project string, name RsrcName, locators map[string]string) []rsrcFullNameEntry {
+	entry := log.WithField("name", name)
+
+	parent, child, ok := splitParentName(name)
+	if !ok {
+		entry.Error(`KMS key name must have the form "<keyRing>/<cryptoKey>"`)
+		return nil
+	}
+
+	var b bytes.Buffer
+	dot := rsrcInfo{
+		Project: project,
+		Parent:  parent,
+		Name:    child,
+		L:       locators,
+	}
+	if err := kmsKeyFullNameT.Execute(&b, &dot); err != nil {
+		entry.WithError(err).Fatal("kmsKeyFullNameT.Execute")
+	}
+
+	return []rsrcFullNameEntry{
+		{
+			rsrcKind:     rkKMSKeys,
+			rsrcName:     name,
+			rsrcFullName: RsrcFullName(b.String()),
+		},
+	}
+}
+
+// Regional resources (Cloud Run services, Cloud Functions, Cloud Tasks queues,
+// Artifact Registry repositories) live in the owner's project at the location
+// corresponding to the current region.
+// Services and functions are named after the apps they run (i.e., their names are
+// app names), so no name template is needed for them.
+const regionalFullNameTText = "projects/{{ .Project }}/locations/{{ .L.location }}/{{ .Kind }}/{{ .Name }}"
+
+var regionalFullNameT = template.Must(
+	template.New("regionalFullName").Option("missingkey=error").Parse(regionalFullNameTText))
+
+func makeRegionalFullName(collection, project, id string, locators map[string]string) RsrcFullName {
+	var b bytes.Buffer
+	dot := rsrcInfo{
+		Project: project,
+		Kind:    collection,
+		Name:    id,
+		L:       locators,
+	}
+	if err := regionalFullNameT.Execute(&b, &dot); err != nil {
+		log.WithError(err).WithField("id", id).Fatalf("regionalFullNameT.Execute(%s)", collection)
+	}
+	return RsrcFullName(b.String())
+}
+
+func makeRegionalFullNames(rsrcKind RsrcKind, collection, project string, name RsrcName, locators map[string]string) []rsrcFullNameEntry {
+	return []rsrcFullNameEntry{
+		{
+			rsrcKind:     rsrcKind,
+			rsrcName:     name,
+			rsrcFullName: makeRegionalFullName(collection, project, string(name), locators),
+		},
+	}
+}
+
+const repositoryNameTText = "{{ .Name }}-{{ .L.stage }}"
+
+var repositoryNameT = template.Must(
+	template.New("repositoryName").Option("missingkey=error").Parse(repositoryNameTText))
+
+func makeRepositoryFullNames(project string, name RsrcName, locators map[string]string) []rsrcFullNameEntry {
+	var b bytes.Buffer
+	dot := rsrcInfo{Name: string(name), L: locators}
+	if err := repositoryNameT.Execute(&b, &dot); err != nil {
+		log.WithError(err).WithField("name", name).Fatal("repositoryNameT.Execute")
+	}
+
+	return []rsrcFullNameEntry{
+		{
+			rsrcKind:     rkArtifactsRepositories,
+			rsrcName:     name,
+			rsrcFullName: makeRegionalFullName("repositories", project, b.String(), locators),
+		},
+	}
+}
+
+// makeLiteralIDFullNames returns the full names of a resource whose ID (e.g., bucket
+// name or topic ID) is given literally rather than derived from its declared name, for
+// kinds whose IDs are normally derived. It returns false for other kinds, whose IDs
+// are their declared names.
+func makeLiteralIDFullNames(rsrcKind RsrcKind, project string, name RsrcName, id string, locators map[string]string) ([]rsrcFullNameEntry, bool) {
+	entry := log.WithFields(log.Fields{"kind": rsrcKind, "name": name, "id": id})
+
+	var b bytes.Buffer
+	dot := rsrcInfo{Project: project, Name: id, L: locators}
+	switch rsrcKind {
+	case rkBuckets:
+		if err := bucketFullNameT.Execute(&b, &dot); err != nil {
+			entry.WithError(err).Fatal("bucketFullNameT.Execute")
+		}
+		return makeLiteralFullNames(rsrcKind, name, RsrcFullName(b.String())), true
+	case rkQueues, rkTopics:
+		dot.Kind = "topics"
+		if err := pubsubFullNameT.Execute(&b, &dot); err != nil {
+			entry.WithError(err).Fatal("pubsubFullNameT.Execute(topics)")
+		}
+		return makeLiteralFullNames(rsrcKind, name, RsrcFullName(b.String())), true
+	case rkArtifactsRepositories:
+		return makeLiteralFullNames(rsrcKind, name, makeRegionalFullName("repositories", project, id, locators)), true
+	default:
+		return nil, false
+	}
+}
+
+// makeLiteralFullNames returns the full names of a resource whose full name is given
+// literally. A queue's literal full name is that of its topic; its subscription has
+// the same ID.
+func makeLiteralFullNames(rsrcKind RsrcKind, name RsrcName, fullName RsrcFullName) []rsrcFullNameEntry {
+	if rsrcKind != rkQueues {
+		return []rsrcFullNameEntry{
+			{
+				rsrcKind:     rsrcKind,
+				rsrcName:     name,
+				rsrcFullName: fullName,
+			},
+		}
+	}
+	return []rsrcFullNameEntry{
+		{
+			rsrcKind:     rkQueuesTopics,
+			rsrcName:     name,
+			rsrcFullName: fullName,
+		},
+		{
+			rsrcKind:     rkQueuesSubscriptions,
+			rsrcName:     name,
+			rsrcFullName: RsrcFullName(strings.Replace(string(fullName), "/topics/", "/subscriptions/", 1)),
+		},
+	}
+}
+
+// Spanner databases and Bigtable tables are declared as "<instance>/<name>";
+// Bigtable instances and Firestore databases by their own IDs.
+const (
+	instanceFullNameTText          = "projects/{{ .Project }}/instances/{{ .Name }}"
+	instanceChildFullNameTText     = "projects/{{ .Project }}/instances/{{ .Parent }}/{{ .Kind }}/{{ .Name }}"
+	firestoreDatabaseFullNameTText = "projects/{{ .Project }}/databases/{{ .Name }}"
+)
+
+var (
+	instanceFullNameT = template.Must(
+		template.New("instanceFullName").Option("missingkey=error").Parse(instanceFullNameTText))
+	instanceChildFullNameT = template.Must(
+		template.New("instanceChildFullName").Option("missingkey=error").Parse(instanceChildFullNameTText))
+	firestoreDatabaseFullNameT = template.Must(
+		template.New("firestoreDatabaseFullName").Option("missingkey=error").Parse(firestoreDatabaseFullNameTText))
+)
+
+func makeDatabaseFullNames(rsrcKind RsrcKind, project string, name RsrcName, locators map[string]string) []rsrcFullNameEntry {
+	entry := log.WithFields(log.Fields{"kind": rsrcKind, "name": name})
+
+	dot := rsrcInfo{
+		Project: project,
+		Name:    string(name),
+		L:       locators,
+	}
+	var t *template.Template
+	switch rsrcKind {
+	case rkSpannerDatabases, rkBigtableTables:
+		parent, child, ok := splitParentName(name)
+		if !ok {
+			entry.Error(`name must have the form "<instance>/<name>"`)
+			return nil
+		}
+		t = instanceChildFullNameT
+		dot.Parent, dot.Name = parent, child
+		dot.Kind = "databases"
+		if rsrcKind == rkBigtableTables {
+			dot.Kind = "tables"
+		}
+	case rkBigtableInstances:
+		t = instanceFullNameT
+	case rkFirestoreDatabases:
+		t = firestoreDatabaseFullNameT
+	}
+
+	var b bytes.Buffer
+	if err := t.Execute(&b, &dot); err != nil {
+		entry.WithError(err).Fatalf("%s.Execute", t.Name())
+	}
+
+	return []rsrcFullNameEntry{
+		{
+			rsrcKind:     rsrcKind,
+			rsrcName:     name,
+			rsrcFullName: RsrcFullName(b.String()),
+		},
+	}
+}
+
+// Google-managed service agents are named after the number (not the ID) of the
+// project they act for.
+const (
+	gcsServiceAgentTText    = "service-{{ .Name }}@gs-project-accounts.iam.gserviceaccount.com"
+	pubsubServiceAgentTText = "service-{{ .Name }}@gcp-sa-pubsub.iam.gserviceaccount.com"
+)
+
+var (
+	gcsServiceAgentT = template.Must(
+		template.New("gcsServiceAgent").Option("missingkey=error").Parse(gcsServiceAgentTText))
+	pubsubServiceAgentT = template.Must(
+		template.New("pubsubServiceAgent").Option("missingkey=error").Parse(pubsubServiceAgentTText))
+)
+
+func makeServiceAgentName(t *template.Template, projectNumber string) GSAName {
+	var b bytes.Buffer
+	dot := rsrcInfo{Name: projectNumber}
+	if err := t.Execute(&b, &dot); err != nil {
+		log.WithError(err).WithField("projectNumber", projectNumber).Fatalf("%s.Execute", t.Name())
+	}
+	return GSAName(b.String())
+}
@@ -2,6 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 )
 
 type (
@@ -15,56 +19,379 @@ type (
 	RsrcName     string
 	RsrcFullName string
 	OperName     string
+	Principal    string // an IAM member, e.g. "group:eng@example.com"
 )
 
+// principalTypes are the IAM member types a Principal may have.
+var principalTypes = []string{"serviceAccount", "group", "user", "principalSet"}
+
+func (p Principal) valid() bool {
+	for _, t := range principalTypes {
+		if strings.HasPrefix(string(p), t+":") && len(p) > len(t)+1 {
+			return true
+		}
+	}
+	return false
+}
+
 //
 // Input Types
 //
 
-type Apps map[NSName][]AppName
+// Namespace declares the apps in a namespace. In YAML it may be given either as a
+// bare list of app names or as a mapping with an "apps" key plus optional attributes.
+type Namespace struct {
+	Apps []AppDecl
+
+	// Defaults for the namespace's apps; see AppDecl.
+	Runtime        string
+	RuntimeProject string
+	IAMProject     string
+	BaselineRoles  []IAMRole
+
+	// The identity that deploys the namespace's apps, e.g. "serviceAccount:<email>"
+	// or a workload identity federation "principalSet://..." for CI/CD pipelines.
+	Deployer Principal
+}
+
+func (ns *Namespace) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &ns.Apps); err == nil {
+		return nil
+	}
+	type namespace Namespace // avoid recursing into this method
+	if err := json.Unmarshal(b, (*namespace)(ns)); err != nil {
+		return err
+	}
+	if len(ns.Deployer) > 0 && !ns.Deployer.valid() {
+		return fmt.Errorf("deployer: %q is not a valid IAM member", ns.Deployer)
+	}
+	return nil
+}
+
+type Apps map[NSName]Namespace
+
+// AppDecl declares an app. In YAML it may be given either as a bare app name or as
+// a mapping with a "name" key plus optional attributes, which override those of the
+// app's namespace.
+type AppDecl struct {
+	Name AppName
+
+	// The platform the app runs on, which determines the identity bindings its GSA
+	// needs; a key of ResourceUsage.Runtimes (default "gke").
+	Runtime string
+
+	// The project the app runs in (default: the shared GKE project for apps on GKE,
+	// none otherwise); for apps on GKE, the project whose workload identity pool
+	// their KSAs belong to. May be a template, as IAMProject may.
+	RuntimeProject string
+
+	// Project-level roles granted to the app's GSA on its runtime project, if it has
+	// one; these replace (rather than add to) ResourceUsage.BaselineRoles.
+	BaselineRoles []IAMRole
+
+	// The project the app's GSA is created in (default: the shared IAM project), or
+	// else the email address of an existing GSA the app runs as. Either may be a
+	// template, e.g. "acme-iam-{{ .L.stage }}".
+	IAMProject string
+	GSA        GSAName
+
+	// Another app whose GSA this app deliberately runs as, e.g. the dispatcher of a
+	// legacy system whose worker shares its identity. The apps' usage is granted to
+	// the shared GSA, and each app's KSA can impersonate it.
+	SharesGSAWith AppName
+
+	nsName NSName // set when names are derived
+}
+
+func (d *AppDecl) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &d.Name); err == nil {
+		return nil
+	}
+	type appDecl AppDecl // avoid recursing into this method
+	return json.Unmarshal(b, (*appDecl)(d))
+}
+
+// Selector restricts a declaration to runs for some stages and/or regions, or more
+// generally to runs with particular locator values. An empty Selector selects all runs.
+type Selector struct {
+	Stages  []string
+	Regions []string
+	Only    map[string]string // locator name -> value
+}
+
+func (s *Selector) selects(locators map[string]string) bool {
+	if len(s.Stages) > 0 && !contains(s.Stages, locators["stage"]) {
+		return false
+	}
+	if len(s.Regions) > 0 && !contains(s.Regions, locators["region"]) {
+		return false
+	}
+	for k, v := range s.Only {
+		if locators[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// describe describes the runs s selects, e.g. "stages prod; regions usce1", or
+// returns "" if it selects all runs.
+func (s *Selector) describe() string {
+	var parts []string
+	if len(s.Stages) > 0 {
+		parts = append(parts, "stages "+strings.Join(s.Stages, ","))
+	}
+	if len(s.Regions) > 0 {
+		parts = append(parts, "regions "+strings.Join(s.Regions, ","))
+	}
+	var only []string
+	for k, v := range s.Only {
+		only = append(only, k+"="+v)
+	}
+	sort.Strings(only)
+	return strings.Join(append(parts, only...), "; ")
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// RsrcDecl declares a single resource. In YAML it may be given either as a
+// bare resource name or as a mapping with a "name" key plus optional attributes.
+// A resource may be declared more than once with different selectors (e.g., with
+// IDs for prod and named by the naming templates elsewhere), provided no run
+// selects more than one of its declarations.
+type RsrcDecl struct {
+	Name   RsrcName
+	KMSKey RsrcName // CMEK key (a "kms.keys" resource name) protecting this resource
+	Selector
+
+	// Literal names, by stage, of a legacy resource whose names do not follow the
+	// naming templates: its ID (for buckets, queues, topics and repositories, whose
+	// IDs are otherwise derived from Name) or its full resource name.
+	IDs       map[string]string
+	FullNames map[string]string
+
+	// Overrides of the run's "company", "unit" or "stage" locators for a resource
+	// belonging to another company, unit or stage. Grants of access to such resources
+	// are reported (see derivePolicies).
+	Locators map[string]string
+
+	// For "tasks.queues": the app whose GSA is named in the OIDC tokens carried by
+	// the queue's tasks. Enqueuers must be able to act as that GSA.
+	OIDCServiceAccount AppName
+
+	// For "queues": where undeliverable messages go.
+	DeadLetter *DeadLetterPolicy
+
+	// For "queues": the service to which the queue's subscription pushes messages.
+	Push *PushDecl
+
+	// For "buckets": where object change notifications are published.
+	Notifications []NotificationDecl
+
+	// Set when names are derived
+	ownerKey RsrcOwnerKey
+	project  string            // the owner's project
+	locators map[string]string // the run's, with Locators applied
+	boundary []string          // Locators differing from the run's, as "name=value"
+}
+
+func (d *RsrcDecl) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &d.Name); err == nil {
+		return nil
+	}
+	type rsrcDecl RsrcDecl // avoid recursing into this method
+	return json.Unmarshal(b, (*rsrcDecl)(d))
+}
+
+// DeadLetterPolicy sends messages that cannot be delivered from a queue's subscription
+// to a dead-letter queue (see deadLetterQueueName); its Operator app subscribes to
+// the dead-letter queue to inspect or replay them.
+type DeadLetterPolicy struct {
+	Operator AppName
+}
+
+// PushDecl makes a queue's subscription push messages to Service (a "services"
+// resource name), authenticating with OIDC tokens for the GSA of ServiceAccount,
+// an app name. ServiceAccount defaults to the receiving service's own app.
+type PushDecl struct {
+	Service        RsrcName
+	ServiceAccount AppName
+}
+
+// NotificationDecl publishes a bucket's object change notifications to Topic,
+// a "queues" or "topics" resource name.
+type NotificationDecl struct {
+	Topic            RsrcName
+	EventTypes       []string // all event types if empty
+	ObjectNamePrefix string
+}
+
+type Resources map[RsrcKind]map[RsrcOwnerKey][]RsrcDecl
+
+// OwnerDecl maps a resource owner key to the ID of the project owning its resources,
+// for owners whose project IDs do not follow the usual convention (see
+// makeProjectName), e.g. legacy projects. Project IDs are templates, in which
+// {{ .Name }} is the owner key and {{ .L.<locator> }} a locator value. In YAML an
+// OwnerDecl may be given either as a bare project ID or as a mapping.
+type OwnerDecl struct {
+	Project string            // for stages not in Stages
+	Stages  map[string]string // stage -> project ID
+}
+
+func (d *OwnerDecl) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &d.Project); err == nil {
+		return nil
+	}
+	type ownerDecl OwnerDecl // avoid recursing into this method
+	return json.Unmarshal(b, (*ownerDecl)(d))
+}
 
-type Resources map[RsrcKind]map[RsrcOwnerKey][]RsrcName
+type Owners map[RsrcOwnerKey]OwnerDecl
 
 // type Permissions: see permissions.go; may ultimately be loaded separately from usage
 
-type Usage map[AppName]map[RsrcKind]map[OperName][]RsrcName
+// UsageEntry names a resource used by an app. In YAML it may be given either as a
+// bare resource name or as a mapping with a "name" key plus optional attributes
+// restricting when the usage is allowed.
+type UsageEntry struct {
+	Name      RsrcName
+	Expires   string // an RFC 3339 timestamp, when access ends, or a date (UTC), the last day of access
+	Condition *IAMCondition
+	Selector
+
+	expiresAt time.Time
+}
+
+func (e *UsageEntry) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &e.Name); err == nil {
+		return nil
+	}
+	type usageEntry UsageEntry // avoid recursing into this method
+	if err := json.Unmarshal(b, (*usageEntry)(e)); err != nil {
+		return err
+	}
+	if len(e.Expires) > 0 {
+		// A date is inclusive: access ends at the following midnight.
+		t, err := time.Parse("2006-01-02", e.Expires)
+		if err == nil {
+			t = t.AddDate(0, 0, 1)
+		} else {
+			t, err = time.Parse(time.RFC3339, e.Expires)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: expires: %q is neither a date nor an RFC 3339 timestamp", e.Name, e.Expires)
+		}
+		e.expiresAt = t.UTC()
+	}
+	if c := e.Condition; c != nil && (len(c.Title) == 0 || len(c.Expression) == 0) {
+		return fmt.Errorf("%s: condition must have a title and an expression", e.Name)
+	}
+	return nil
+}
+
+type AppUsage map[RsrcKind]map[OperName][]UsageEntry
+
+type Usage map[AppName]AppUsage
+
+// NamespaceUsage is usage shared by every app in a namespace.
+type NamespaceUsage map[NSName]AppUsage
+
+// ProjectNumbers maps project IDs to project numbers, which are needed to
+// name Google-managed service agents.
+type ProjectNumbers map[string]string
+
+// Principals declares identities other than apps' own GSAs. Each is given a name
+// by which Usage can refer to it just as it refers to apps.
+type Principals struct {
+	Groups          map[AppName]string // Google Groups
+	Users           map[AppName]string
+	ServiceAccounts map[AppName]string // GSAs not generated by genauth
+	PrincipalSets   map[AppName]string // e.g. workload identity federation pools
+}
+
+// RuntimeBindings are the identity bindings granted on the GSA of each app running
+// on a runtime: Self roles to the GSA itself, and WorkloadIdentity roles to the
+// app's KSA (meaningful only on GKE).
+type RuntimeBindings struct {
+	Self             []IAMRole
+	WorkloadIdentity []IAMRole
+}
 
 type ResourceUsage struct {
-	Resources   Resources
-	Permissions Permissions
-	Usage       Usage
+	Resources      Resources
+	Owners         Owners // owners not following the project naming convention
+	Permissions    Permissions
+	Principals     Principals
+	Runtimes       map[string]RuntimeBindings // overrides defaultRuntimes entries
+	BaselineRoles  []IAMRole                  // replaces defaultBaselineRoles if given
+	Usage          Usage
+	NamespaceUsage NamespaceUsage
+	NodeUsage      AppUsage // usage by the GKE node GSA, e.g. for image pulls
+	ProjectNumbers ProjectNumbers
 }
 
 //
 // Computed Types
 //
 
+type IAMCondition struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Expression  string `json:"expression"`
+}
+
 type RoleBindingCore struct {
-	IAMRole IAMRole   `json:"role"`
-	Members []GSAName `json:"members"`
+	IAMRole   IAMRole       `json:"role"`
+	Members   []Principal   `json:"members"`
+	Condition *IAMCondition `json:"condition,omitempty"`
 }
 
 type RoleBinding struct {
 	RoleBindingCore
-	membersMap map[GSAName]bool
+	membersMap map[Principal]bool
 }
 
-func (rb *RoleBinding) Add(gsaName GSAName) {
-	rb.membersMap[gsaName] = true
+func (rb *RoleBinding) Add(member Principal) {
+	rb.membersMap[member] = true
 }
 
 func (rb *RoleBinding) MarshalJSON() ([]byte, error) {
+	core := rb.RoleBindingCore
+	core.Members = nil
 	for m := range rb.membersMap {
-		rb.Members = append(rb.Members, "serviceAccount:"+m)
+		core.Members = append(core.Members, m)
 	}
-	return json.Marshal(&rb.RoleBindingCore)
+	sort.Slice(core.Members, func(i, j int) bool { return core.Members[i] < core.Members[j] })
+	return json.Marshal(&core)
+}
+
+// Bindings of the same role with different conditions are distinct bindings.
+type roleBindingKey struct {
+	role      IAMRole
+	condition IAMCondition
 }
 
-type RoleBindingMap map[IAMRole]*RoleBinding
+type RoleBindingMap map[roleBindingKey]*RoleBinding
+
+// BucketNotification is the notification configuration to be created on a bucket.
+type BucketNotification struct {
+	Topic            RsrcFullName `json:"topic"`
+	EventTypes       []string     `json:"eventTypes,omitempty"`
+	ObjectNamePrefix string       `json:"objectNamePrefix,omitempty"`
+	PayloadFormat    string       `json:"payloadFormat"`
+}
 
 type ResourcePolicyCore struct {
-	RsrcFullName RsrcFullName   `json:"resource"`
-	RoleBindings []*RoleBinding `json:"bindings"`
+	RsrcFullName  RsrcFullName          `json:"resource"`
+	RoleBindings  []*RoleBinding        `json:"bindings"`
+	Notifications []*BucketNotification `json:"notifications,omitempty"`
 }
 
 type ResourcePolicy struct {
@@ -72,32 +399,80 @@ type ResourcePolicy struct {
 	roleBindingsMap RoleBindingMap
 }
 
-func (rp *ResourcePolicy) Add(roles []IAMRole, gsaName GSAName) {
+func (rp *ResourcePolicy) Add(roles []IAMRole, member Principal) {
+	rp.AddConditional(roles, nil, member)
+}
+
+// AddConditional adds bindings that are in effect only when condition holds;
+// a nil condition means the bindings are unconditional.
+func (rp *ResourcePolicy) AddConditional(roles []IAMRole, condition *IAMCondition, member Principal) {
 	for _, role := range roles {
-		rb, ok := rp.roleBindingsMap[role]
+		key := roleBindingKey{role: role}
+		if condition != nil {
+			key.condition = *condition
+		}
+		rb, ok := rp.roleBindingsMap[key]
 		if !ok {
 			rb = &RoleBinding{
 				RoleBindingCore: RoleBindingCore{
-					IAMRole: role,
+					IAMRole:   role,
+					Condition: condition,
 				},
-				membersMap: make(map[GSAName]bool),
+				membersMap: make(map[Principal]bool),
 			}
-			rp.roleBindingsMap[role] = rb
+			rp.roleBindingsMap[key] = rb
 		}
-		rb.Add(gsaName)
+		rb.Add(member)
 	}
 }
 
+// MarshalJSON orders bindings by role and then condition, so that identical
+// policies marshal identically.
 func (rp *ResourcePolicy) MarshalJSON() ([]byte, error) {
+	core := rp.ResourcePolicyCore
+	core.RoleBindings = nil
 	for _, rb := range rp.roleBindingsMap {
-		rp.RoleBindings = append(rp.RoleBindings, rb)
+		core.RoleBindings = append(core.RoleBindings, rb)
 	}
-	return json.Marshal(&rp.ResourcePolicyCore)
+	sort.Slice(core.RoleBindings, func(i, j int) bool {
+		a, b := core.RoleBindings[i], core.RoleBindings[j]
+		if a.IAMRole != b.IAMRole {
+			return a.IAMRole < b.IAMRole
+		}
+		var ac, bc IAMCondition
+		if a.Condition != nil {
+			ac = *a.Condition
+		}
+		if b.Condition != nil {
+			bc = *b.Condition
+		}
+		if ac.Title != bc.Title {
+			return ac.Title < bc.Title
+		}
+		if ac.Expression != bc.Expression {
+			return ac.Expression < bc.Expression
+		}
+		return ac.Description < bc.Description
+	})
+	return json.Marshal(&core)
 }
 
 type ResourcePolicyMap map[RsrcFullName]*ResourcePolicy
 
-func (rpm ResourcePolicyMap) Add(rsrcFullName RsrcFullName, roles []IAMRole, gsaName GSAName) {
+func (rpm ResourcePolicyMap) Add(rsrcFullName RsrcFullName, roles []IAMRole, member Principal) {
+	rpm.AddConditional(rsrcFullName, roles, nil, member)
+}
+
+func (rpm ResourcePolicyMap) AddConditional(rsrcFullName RsrcFullName, roles []IAMRole, condition *IAMCondition, member Principal) {
+	rpm.get(rsrcFullName).AddConditional(roles, condition, member)
+}
+
+func (rpm ResourcePolicyMap) AddNotification(rsrcFullName RsrcFullName, n *BucketNotification) {
+	rp := rpm.get(rsrcFullName)
+	rp.Notifications = append(rp.Notifications, n)
+}
+
+func (rpm ResourcePolicyMap) get(rsrcFullName RsrcFullName) *ResourcePolicy {
 	rp, ok := rpm[rsrcFullName]
 	if !ok {
 		rp = &ResourcePolicy{
@@ -108,5 +483,5 @@ func (rpm ResourcePolicyMap) Add(rsrcFullName RsrcFullName, roles []IAMRole, gsa
 		}
 		rpm[rsrcFullName] = rp
 	}
-	rp.Add(roles, gsaName)
+	return rp
 }
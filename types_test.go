@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageEntryExpires(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		expires string // as written in YAML
+		want    string // RFC 3339 time access ends
+		err     string // expected in the error, if any
+	}{
+		{name: "date", expires: "2026-12-31", want: "2027-01-01T00:00:00Z"},
+		{name: "quoted date", expires: `"2026-12-31"`, want: "2027-01-01T00:00:00Z"},
+		{name: "midnight timestamp", expires: "2026-12-31T00:00:00Z", want: "2026-12-31T00:00:00Z"},
+		{name: "quoted midnight timestamp", expires: `"2026-12-31T00:00:00Z"`, want: "2026-12-31T00:00:00Z"},
+		{name: "timestamp", expires: "2026-12-31T17:30:00Z", want: "2026-12-31T17:30:00Z"},
+		{name: "offset timestamp", expires: "2026-12-31T17:30:00-08:00", want: "2027-01-01T01:30:00Z"},
+		{name: "invalid date", expires: "2026-13-01", err: "neither a date nor an RFC 3339 timestamp"},
+		{name: "timestamp without zone", expires: `"2026-12-31T17:30:00"`, err: "neither a date nor an RFC 3339 timestamp"},
+		{name: "not a time", expires: "soon", err: "neither a date nor an RFC 3339 timestamp"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var entries []UsageEntry
+			err := unmarshalYAML([]byte("- name: b1\n  expires: "+tc.expires+"\n"), &entries)
+			if len(tc.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := entries[0].expiresAt.Format(time.RFC3339); got != tc.want {
+				t.Errorf("got expiry %v, want %v", got, tc.want)
+			}
+		})
+	}
+}